@@ -0,0 +1,127 @@
+// batch
+package mp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	maxBatchUsers       = 100
+	defaultBatchWorkers = 4
+)
+
+// UsersInfo returns the info of at most 100 users at once.
+func (c *Client) UsersInfo(openIds []string, lang LangType) ([]User, error) {
+	return c.UsersInfoContext(context.Background(), openIds, lang)
+}
+
+func (c *Client) UsersInfoContext(ctx context.Context, openIds []string, lang LangType) ([]User, error) {
+	if len(openIds) == 0 || len(openIds) > maxBatchUsers {
+		return nil, &APIError{Code: OpenIdListLenInvalid, Endpoint: userBatchGetUri,
+			Msg: fmt.Sprintf("%d openids, want 1 to %d", len(openIds), maxBatchUsers)}
+	}
+
+	type item struct {
+		OpenId string   `json:"openid"`
+		Lang   LangType `json:"lang,omitempty"`
+	}
+	var req struct {
+		Users []item `json:"user_list"`
+	}
+	var resp struct {
+		Users []User `json:"user_info_list"`
+	}
+
+	for _, openId := range openIds {
+		req.Users = append(req.Users, item{openId, lang})
+	}
+	if err := c.postJson(ctx, userBatchGetUri, "", &req, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Users, nil
+}
+
+type BatchConfig struct {
+	Workers  int           // concurrent requests, default 4
+	Interval time.Duration // minimal interval between two requests, 0 for no limit
+}
+
+// UserBatch is the result of a chunk of BatchUserInfo, either Users or Err is set.
+type UserBatch struct {
+	OpenIds []string
+	Users   []User
+	Err     error
+}
+
+// BatchUserInfo fetches the info of any number of users, by chunks of 100
+// requested concurrently. The results are sent as they arrive, in no
+// particular order, the channel is closed when all chunks are done or
+// ctx is canceled.
+func (c *Client) BatchUserInfo(ctx context.Context, openIds []string, lang LangType, conf BatchConfig) <-chan UserBatch {
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = defaultBatchWorkers
+	}
+
+	var limit <-chan time.Time
+	var ticker *time.Ticker
+	if conf.Interval > 0 {
+		ticker = time.NewTicker(conf.Interval)
+		limit = ticker.C
+	}
+
+	chunks := make(chan []string)
+	go func() {
+		defer close(chunks)
+		for i := 0; i < len(openIds); i += maxBatchUsers {
+			end := i + maxBatchUsers
+			if end > len(openIds) {
+				end = len(openIds)
+			}
+			select {
+			case chunks <- openIds[i:end]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	out := make(chan UserBatch)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				if limit != nil {
+					select {
+					case <-limit:
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				users, err := c.UsersInfoContext(ctx, chunk, lang)
+				select {
+				case out <- UserBatch{OpenIds: chunk, Users: users, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		if ticker != nil {
+			ticker.Stop()
+		}
+		close(out)
+	}()
+
+	return out
+}
@@ -0,0 +1,95 @@
+// batch_test.go
+package mp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchUserInfo(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(userBatchGetUri, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Users []struct {
+				OpenId string `json:"openid"`
+			} `json:"user_list"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var resp struct {
+			Users []User `json:"user_info_list"`
+		}
+		for _, u := range req.Users {
+			if u.OpenId == "bad" {
+				fmt.Fprint(w, `{"errcode":40003,"errmsg":"invalid openid"}`)
+				return
+			}
+			resp.Users = append(resp.Users, User{OpenId: u.OpenId, Subscribe: 1})
+		}
+		json.NewEncoder(w).Encode(&resp)
+	})
+	c := newTestClient(t, mux)
+
+	var openIds []string
+	for i := 0; i < 250; i++ {
+		openIds = append(openIds, fmt.Sprintf("o%d", i))
+	}
+	openIds[220] = "bad"
+
+	users, failed, batches := 0, 0, 0
+	for batch := range c.BatchUserInfo(context.Background(), openIds, LangCN, BatchConfig{Workers: 2}) {
+		batches++
+		if batch.Err != nil {
+			failed += len(batch.OpenIds)
+			continue
+		}
+		users += len(batch.Users)
+	}
+	if batches != 3 || users != 200 || failed != 50 {
+		t.Fatalf("%d batches, %d users, %d failed", batches, users, failed)
+	}
+
+	if _, err := c.UsersInfo(openIds[:101], LangCN); err == nil {
+		t.Fatal("101 openids accepted")
+	}
+}
+
+func TestBatchUserInfoInterval(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	mux := http.NewServeMux()
+	mux.HandleFunc(userBatchGetUri, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		fmt.Fprint(w, `{"user_info_list":[]}`)
+	})
+	c := newTestClient(t, mux)
+
+	openIds := make([]string, 5*maxBatchUsers)
+	for i := range openIds {
+		openIds[i] = fmt.Sprintf("o%d", i)
+	}
+
+	interval := 50 * time.Millisecond
+	conf := BatchConfig{Workers: 4, Interval: interval}
+	for range c.BatchUserInfo(context.Background(), openIds, LangCN, conf) {
+	}
+
+	if len(times) != 5 {
+		t.Fatalf("%d requests, want 5", len(times))
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for i := 1; i < len(times); i++ {
+		// allow for the scheduling of the workers
+		if gap := times[i].Sub(times[i-1]); gap < interval*3/4 {
+			t.Errorf("request %d sent %v after the previous one, want %v", i, gap, interval)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// blacklist
+package mp
+
+import (
+	"context"
+	"fmt"
+)
+
+// maximal openids of batch blacklisting
+const maxBlacklistOpenIds = 20
+
+// Blacklist returns up to 10000 openids of the blocked users after
+// start, with the total number of blocked users. Like Followers, next
+// is the last openid returned, the page after the last one is empty.
+func (c *Client) Blacklist(start string) (int, []string, string, error) {
+	return c.BlacklistContext(context.Background(), start)
+}
+
+func (c *Client) BlacklistContext(ctx context.Context, start string) (int, []string, string, error) {
+	var req struct {
+		Begin string `json:"begin_openid"`
+	}
+
+	var resp struct {
+		Total int `json:"total"`
+		Count int `json:"count"`
+		Data  struct {
+			OpenId []string `json:"openid"`
+		} `json:"data"`
+		Next string `json:"next_openid"`
+	}
+
+	req.Begin = start
+	if err := c.postJson(ctx, blacklistUri, "", &req, &resp); err != nil {
+		return 0, nil, "", err
+	}
+
+	return resp.Total, resp.Data.OpenId, resp.Next, nil
+}
+
+// BlockUsers blacklists the users openIds, at most 20 at once.
+func (c *Client) BlockUsers(openIds []string) error {
+	return c.BlockUsersContext(context.Background(), openIds)
+}
+
+func (c *Client) BlockUsersContext(ctx context.Context, openIds []string) error {
+	return c.batchBlacklist(ctx, blacklistBatchUri, openIds)
+}
+
+// UnblockUsers removes the users openIds from the blacklist, at most 20 at once.
+func (c *Client) UnblockUsers(openIds []string) error {
+	return c.UnblockUsersContext(context.Background(), openIds)
+}
+
+func (c *Client) UnblockUsersContext(ctx context.Context, openIds []string) error {
+	return c.batchBlacklist(ctx, blacklistBatchDelUri, openIds)
+}
+
+func (c *Client) batchBlacklist(ctx context.Context, uri string, openIds []string) error {
+	if len(openIds) == 0 || len(openIds) > maxBlacklistOpenIds {
+		return &APIError{Code: OpenIdListLenInvalid, Endpoint: uri,
+			Msg: fmt.Sprintf("%d openids, want 1 to %d", len(openIds), maxBlacklistOpenIds)}
+	}
+
+	var req struct {
+		OpenIds []string `json:"openid_list"`
+	}
+
+	req.OpenIds = openIds
+	return c.sendJson(ctx, uri, &req)
+}
@@ -0,0 +1,60 @@
+// blacklist_test.go
+package mp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestBlacklist(t *testing.T) {
+	var blocked, remark map[string]interface{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(blacklistUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total":2,"count":2,"data":{"openid":["o1","o2"]},"next_openid":"o2"}`)
+	})
+	mux.HandleFunc(blacklistBatchUri, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&blocked)
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	mux.HandleFunc(userRemarkUri, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&remark)
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	mux.HandleFunc(userInfoUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"subscribe":1,"openid":"o1","remark":"vip","tagid_list":[128,2],
+			"subscribe_scene":"ADD_SCENE_QR_CODE","qr_scene":98765,"qr_scene_str":""}`)
+	})
+	c := newTestClient(t, mux)
+
+	total, ids, next, err := c.Blacklist("")
+	if err != nil || total != 2 || len(ids) != 2 || next != "o2" {
+		t.Fatalf("blacklist %d %q %q, %v", total, ids, next, err)
+	}
+
+	if err := c.BlockUsers([]string{"o3"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := blocked["openid_list"].([]interface{}); len(list) != 1 || list[0] != "o3" {
+		t.Errorf("block request %v", blocked)
+	}
+	if err := c.UnblockUsers(make([]string, 21)); !errors.Is(err, ErrOpenIdListLenInvalid) {
+		t.Errorf("21 openids: %v", err)
+	}
+
+	if err := c.UpdateRemark("o1", "vip"); err != nil {
+		t.Fatal(err)
+	}
+	if remark["openid"] != "o1" || remark["remark"] != "vip" {
+		t.Errorf("remark request %v", remark)
+	}
+
+	u, err := c.UserInfo("o1", LangCN)
+	if err != nil || u.Remark != "vip" || len(u.TagIdList) != 2 ||
+		u.SubscribeScene != "ADD_SCENE_QR_CODE" || u.QrScene != 98765 {
+		t.Fatalf("user %+v, %v", u, err)
+	}
+}
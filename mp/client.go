@@ -0,0 +1,709 @@
+// client
+package mp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client calls the weixin API on behalf of an official account.
+type Client struct {
+	appId     string
+	appSecret string
+
+	mu     sync.Mutex // guards menu and groups
+	menu   *Menu
+	groups []Group
+
+	menuHistory MenuHistory
+
+	tokenMu     sync.Mutex
+	tokenStore  TokenStore
+	tokenCall   *tokenCall
+	refreshStop chan struct{}
+
+	httpClient *http.Client
+	baseUrl    string
+	logger     Logger
+}
+
+func NewClient(appId, appSecret string, opts ...Option) *Client {
+	o := newOptions(opts)
+	if o.history == nil {
+		o.history = defaultMenuHistory(appId, o.logger)
+	}
+	return &Client{appId: appId, appSecret: appSecret,
+		menuHistory: o.history,
+		tokenStore:  o.tokenStore,
+		httpClient:  o.client,
+		baseUrl:     o.baseUrl,
+		logger:      o.logger}
+}
+
+func (c *Client) requestToken(ctx context.Context) (token Token, err error) {
+	var response struct {
+		AccessToken string `json:"access_token"`
+		Expire      int64  `json:"expires_in"`
+		Error
+	}
+
+	url := c.baseUrl + tokenUri +
+		fmt.Sprintf("?grant_type=client_credential&appid=%s&secret=%s",
+			c.appId, c.appSecret)
+	data, err := c.request(ctx, "GET", url, "", nil)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &response); err != nil {
+		return
+	}
+	if response.Code != Success {
+		err = newAPIError(tokenUri, response.Error)
+		return
+	}
+
+	token.AccessToken = response.AccessToken
+	token.ExpiresAt = time.Now().Add(time.Duration(response.Expire) * time.Second)
+	c.logger.Println("new access token:", token.AccessToken)
+
+	return token, nil
+}
+
+func (c *Client) SetMenu(menu *Menu) error {
+	return c.SetMenuContext(context.Background(), menu)
+}
+
+func (c *Client) SetMenuContext(ctx context.Context, menu *Menu) (err error) {
+	if err = menu.Validate(); err != nil {
+		return
+	}
+	if err = c.sendJson(ctx, menuCreateUri, menu); err == nil {
+		c.setLastMenu(menu)
+	}
+	return
+}
+
+// lastMenu returns the menu last set or got.
+func (c *Client) lastMenu() *Menu {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.menu
+}
+
+func (c *Client) setLastMenu(menu *Menu) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.menu = menu
+}
+
+// GetMenu returns the default menu and the conditional menus.
+func (c *Client) GetMenu() (*Menu, []ConditionalMenu, error) {
+	return c.GetMenuContext(context.Background())
+}
+
+func (c *Client) GetMenuContext(ctx context.Context) (menu *Menu, conditional []ConditionalMenu, err error) {
+	var resp struct {
+		Menu        *Menu `json:"menu"`
+		Conditional []struct {
+			Menu
+			MatchRule MatchRule   `json:"matchrule"`
+			MenuId    json.Number `json:"menuid"`
+		} `json:"conditionalmenu"`
+	}
+
+	if err = c.getJson(ctx, menuQueryUri, "", &resp); err != nil {
+		return
+	}
+
+	menu = resp.Menu
+	for i := range resp.Conditional {
+		m := &resp.Conditional[i]
+		conditional = append(conditional, ConditionalMenu{
+			MenuId:    m.MenuId.String(),
+			Menu:      &m.Menu,
+			MatchRule: m.MatchRule,
+		})
+	}
+
+	c.setLastMenu(menu)
+	return
+}
+
+func (c *Client) DelMenu() error {
+	return c.DelMenuContext(context.Background())
+}
+
+func (c *Client) DelMenuContext(ctx context.Context) (err error) {
+	if err = c.getJson(ctx, menuDelUri, "", nil); err != nil {
+		return
+	}
+
+	c.setLastMenu(nil)
+	return nil
+}
+
+// AddConditionalMenu creates a menu shown to the users matching rule.
+func (c *Client) AddConditionalMenu(menu *Menu, rule MatchRule) (string, error) {
+	return c.AddConditionalMenuContext(context.Background(), menu, rule)
+}
+
+func (c *Client) AddConditionalMenuContext(ctx context.Context, menu *Menu, rule MatchRule) (menuId string, err error) {
+	var req struct {
+		*Menu
+		MatchRule MatchRule `json:"matchrule"`
+	}
+
+	var resp struct {
+		MenuId json.Number `json:"menuid"`
+	}
+
+	if err = menu.Validate(); err != nil {
+		return
+	}
+	req.Menu = menu
+	req.MatchRule = rule
+	if err = c.postJson(ctx, menuAddCondUri, "", &req, &resp); err != nil {
+		return
+	}
+
+	return resp.MenuId.String(), nil
+}
+
+func (c *Client) DelConditionalMenu(menuId string) error {
+	return c.DelConditionalMenuContext(context.Background(), menuId)
+}
+
+func (c *Client) DelConditionalMenuContext(ctx context.Context, menuId string) error {
+	var req struct {
+		MenuId string `json:"menuid"`
+	}
+
+	req.MenuId = menuId
+	return c.sendJson(ctx, menuDelCondUri, &req)
+}
+
+// TryMatchMenu returns the menu shown to userId, which is an openid
+// or a weixin id.
+func (c *Client) TryMatchMenu(userId string) (*Menu, error) {
+	return c.TryMatchMenuContext(context.Background(), userId)
+}
+
+func (c *Client) TryMatchMenuContext(ctx context.Context, userId string) (*Menu, error) {
+	var req struct {
+		UserId string `json:"user_id"`
+	}
+
+	var menu Menu
+
+	req.UserId = userId
+	if err := c.postJson(ctx, menuTryMatchUri, "", &req, &menu); err != nil {
+		return nil, err
+	}
+
+	return &menu, nil
+}
+
+// GetSelfMenuInfo returns the menu in effect, including the one
+// configured in the web console.
+func (c *Client) GetSelfMenuInfo() (*SelfMenuInfo, error) {
+	return c.GetSelfMenuInfoContext(context.Background())
+}
+
+func (c *Client) GetSelfMenuInfoContext(ctx context.Context) (*SelfMenuInfo, error) {
+	var resp struct {
+		IsMenuOpen int `json:"is_menu_open"`
+		Info       struct {
+			Buttons []SelfMenuButton `json:"button"`
+		} `json:"selfmenu_info"`
+	}
+
+	if err := c.getJson(ctx, selfMenuInfoUri, "", &resp); err != nil {
+		return nil, err
+	}
+
+	return &SelfMenuInfo{IsMenuOpen: resp.IsMenuOpen == 1,
+		Buttons: resp.Info.Buttons}, nil
+}
+
+// Deprecated: groups are superseded by tags, use CreateTag.
+func (c *Client) CreateGroup(name string) error {
+	return c.CreateGroupContext(context.Background(), name)
+}
+
+func (c *Client) CreateGroupContext(ctx context.Context, name string) error {
+	var req, resp struct {
+		Grp Group `json:"group"`
+	}
+
+	req.Grp.Name = name
+	if err := c.postJson(ctx, groupCreateUri, "", &req, &resp); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.groups = append(c.groups, resp.Grp)
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Deprecated: use Tags.
+func (c *Client) Groups() ([]Group, error) {
+	return c.GroupsContext(context.Background())
+}
+
+func (c *Client) GroupsContext(ctx context.Context) ([]Group, error) {
+	var resp struct {
+		Groups []Group `json:"groups"`
+	}
+
+	if err := c.getJson(ctx, groupQueryUri, "", &resp); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.groups = resp.Groups
+	c.mu.Unlock()
+
+	return resp.Groups, nil
+}
+
+// Deprecated: use UserTagIds.
+func (c *Client) GroupId(uid string) (int, error) {
+	return c.GroupIdContext(context.Background(), uid)
+}
+
+func (c *Client) GroupIdContext(ctx context.Context, uid string) (gid int, err error) {
+	var req struct {
+		Uid string `json:"openid"`
+	}
+
+	var resp struct {
+		GroupId int `json:"groupid"`
+	}
+
+	req.Uid = uid
+	if err = c.postJson(ctx, GroupIdUri, "", &req, &resp); err != nil {
+		return
+	}
+
+	return resp.GroupId, nil
+}
+
+// Deprecated: use UpdateTag.
+func (c *Client) UpdateGroup(group Group) error {
+	return c.UpdateGroupContext(context.Background(), group)
+}
+
+func (c *Client) UpdateGroupContext(ctx context.Context, group Group) error {
+	var req struct {
+		Grp Group `json:"group"`
+	}
+
+	req.Grp = Group{Id: group.Id, Name: group.Name}
+	return c.sendJson(ctx, groupUpdateUri, &req)
+}
+
+// Deprecated: use TagUsers.
+func (c *Client) MoveMember2Group(uid string, gid int) error {
+	return c.MoveMember2GroupContext(context.Background(), uid, gid)
+}
+
+func (c *Client) MoveMember2GroupContext(ctx context.Context, uid string, gid int) error {
+	var req struct {
+		Uid string `json:"openid"`
+		Gid int    `json:"to_groupid"`
+	}
+
+	req.Uid = uid
+	req.Gid = gid
+	return c.sendJson(ctx, groupMemberUpdateUri, &req)
+}
+
+func (c *Client) UserInfo(uid string, lang LangType) (User, error) {
+	return c.UserInfoContext(context.Background(), uid, lang)
+}
+
+func (c *Client) UserInfoContext(ctx context.Context, uid string, lang LangType) (User, error) {
+	var user User
+
+	query := fmt.Sprintf("&openid=%s&lang=%s", uid, lang)
+	if err := c.getJson(ctx, userInfoUri, query, &user); err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// UpdateRemark sets the remark of the user uid, at most 30 characters.
+func (c *Client) UpdateRemark(uid, remark string) error {
+	return c.UpdateRemarkContext(context.Background(), uid, remark)
+}
+
+func (c *Client) UpdateRemarkContext(ctx context.Context, uid, remark string) error {
+	var req struct {
+		Uid    string `json:"openid"`
+		Remark string `json:"remark"`
+	}
+
+	req.Uid = uid
+	req.Remark = remark
+	return c.sendJson(ctx, userRemarkUri, &req)
+}
+
+func (c *Client) Followers(start string) (int, []string, string, error) {
+	return c.FollowersContext(context.Background(), start)
+}
+
+func (c *Client) FollowersContext(ctx context.Context, start string) (int, []string, string, error) {
+	var resp struct {
+		Total int `json:"total"`
+		Count int `json:"count"`
+		Data  struct {
+			OpenId []string `json:"openid"`
+		} `json:"data"`
+		Next string `json:"next_openid"`
+	}
+
+	query := ""
+	if len(start) != 0 {
+		query = fmt.Sprintf("&next_openid=%s", start)
+	}
+	if err := c.getJson(ctx, followersUri, query, &resp); err != nil {
+		return 0, nil, "", err
+	}
+
+	return resp.Total, resp.Data.OpenId, resp.Next, nil
+}
+
+// if expire != 0, return temp qrcode
+func (c *Client) QRCode(expire, sceneId int) (string, error) {
+	return c.QRCodeContext(context.Background(), expire, sceneId)
+}
+
+func (c *Client) QRCodeContext(ctx context.Context, expire, sceneId int) (string, error) {
+	var req struct {
+		Expire int    `json:"expire_seconds,omitempty"`
+		Action string `json:"action_name"`
+		Info   struct {
+			Scene struct {
+				Id int `json:"scene_id"`
+			} `json:"scene"`
+		} `json:"action_info"`
+	}
+
+	var resp struct {
+		Ticket string `json:"ticket"`
+		Expire int    `json:"expire_seconds"`
+	}
+
+	req.Expire = expire
+	if expire == 0 {
+		req.Action = "QR_LIMIT_SCENE"
+	} else {
+		req.Action = "QR_SCENE"
+	}
+	req.Info.Scene.Id = sceneId
+	if err := c.postJson(ctx, qrCodeCreateUri, "", &req, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.Ticket, nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+func createFormFile(writer *multipart.Writer, fieldname, filename, mime string) (io.Writer, error) {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition",
+		fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			escapeQuotes(fieldname), escapeQuotes(filename)))
+	if len(mime) == 0 {
+		mime = "application/octet-stream"
+	}
+	h.Set("Content-Type", mime)
+	return writer.CreatePart(h)
+}
+
+func makeFormData(filename, mimeType string, content io.Reader) (formData []byte, contentType string, err error) {
+	buf := new(bytes.Buffer)
+	writer := multipart.NewWriter(buf)
+
+	part, err := createFormFile(writer, "media", filename, mimeType)
+	//log.Println(filename, mimeType)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(part, content)
+	if err != nil {
+		return
+	}
+
+	contentType = writer.FormDataContentType()
+	//log.Println(contentType)
+	writer.Close()
+	formData = buf.Bytes()
+
+	return
+}
+
+func (c *Client) UploadMedia(mediaType MediaType, filename string, reader io.Reader) (string, error) {
+	return c.UploadMediaContext(context.Background(), mediaType, filename, reader)
+}
+
+func (c *Client) UploadMediaContext(ctx context.Context, mediaType MediaType, filename string, reader io.Reader) (mediaId string, err error) {
+	var resp struct {
+		Type      string `json:"type"`
+		MediaId   string `json:"media_id"`
+		CreatedAt int64  `json:"created_at"`
+	}
+
+	data, contentType, err := makeFormData(filename, "image/jpeg", reader)
+	if err != nil {
+		return "", err
+	}
+	query := fmt.Sprintf("&type=%s", mediaType)
+	if err := c.post(ctx, mediaUploadUri, query, contentType, data, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.MediaId, nil
+}
+
+func (c *Client) DownloadMedia(mediaId string) (io.Reader, error) {
+	return c.DownloadMediaContext(context.Background(), mediaId)
+}
+
+func (c *Client) DownloadMediaContext(ctx context.Context, mediaId string) (io.Reader, error) {
+	data, err := c.call(ctx, "GET", mediaDownloadUri,
+		fmt.Sprintf("&media_id=%s", mediaId), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewBuffer(data), nil
+}
+
+func (c *Client) SendText(touser string, content string) error {
+	return c.SendTextContext(context.Background(), touser, content)
+}
+
+func (c *Client) SendTextContext(ctx context.Context, touser string, content string) error {
+	var data struct {
+		ServiceMsgHeader
+		Text struct {
+			Content string `json:"content"`
+		} `json:"text"`
+	}
+
+	data.ToUser = touser
+	data.Type = string(MsgText)
+	data.Text.Content = content
+
+	return c.sendJson(ctx, customSendUri, &data)
+}
+
+func (c *Client) SendImage(touser string, mediaId string) error {
+	return c.SendImageContext(context.Background(), touser, mediaId)
+}
+
+func (c *Client) SendImageContext(ctx context.Context, touser string, mediaId string) error {
+	var data struct {
+		ServiceMsgHeader
+		Image struct {
+			MediaId string `json:"media_id"`
+		} `json:"image"`
+	}
+
+	data.ToUser = touser
+	data.Type = string(MsgImage)
+	data.Image.MediaId = mediaId
+
+	return c.sendJson(ctx, customSendUri, &data)
+}
+
+func (c *Client) SendVoice(touser string, mediaId string) error {
+	return c.SendVoiceContext(context.Background(), touser, mediaId)
+}
+
+func (c *Client) SendVoiceContext(ctx context.Context, touser string, mediaId string) error {
+	var data struct {
+		ServiceMsgHeader
+		Voice struct {
+			MediaId string `json:"media_id"`
+		} `json:"voice"`
+	}
+
+	data.ToUser = touser
+	data.Type = string(MsgVoice)
+	data.Voice.MediaId = mediaId
+
+	return c.sendJson(ctx, customSendUri, &data)
+}
+
+func (c *Client) SendVideo(touser string, mediaId string, info TitleDesc) error {
+	return c.SendVideoContext(context.Background(), touser, mediaId, info)
+}
+
+func (c *Client) SendVideoContext(ctx context.Context, touser string, mediaId string, info TitleDesc) error {
+	var data struct {
+		ServiceMsgHeader
+		Video struct {
+			MediaId string `json:"media_id"`
+			TitleDesc
+		} `json:"video"`
+	}
+
+	data.ToUser = touser
+	data.Type = string(MsgVideo)
+	data.Video.MediaId = mediaId
+	data.Video.TitleDesc = info
+
+	return c.sendJson(ctx, customSendUri, &data)
+}
+
+func (c *Client) SendMusic(touser string, info TitleDesc, music Music) error {
+	return c.SendMusicContext(context.Background(), touser, info, music)
+}
+
+func (c *Client) SendMusicContext(ctx context.Context, touser string, info TitleDesc, music Music) error {
+	var data struct {
+		ServiceMsgHeader
+		M struct {
+			TitleDesc
+			Music
+		} `json:"music"`
+	}
+
+	data.ToUser = touser
+	data.Type = string(MsgMusic)
+	data.M.TitleDesc = info
+	data.M.Music = music
+
+	return c.sendJson(ctx, customSendUri, &data)
+}
+
+func (c *Client) SendImageText(touser string, articles []Article) error {
+	return c.SendImageTextContext(context.Background(), touser, articles)
+}
+
+func (c *Client) SendImageTextContext(ctx context.Context, touser string, articles []Article) error {
+	var data struct {
+		ServiceMsgHeader
+		News struct {
+			Articles []Article `json:"articles"`
+		} `json:"news"`
+	}
+
+	data.ToUser = touser
+	data.Type = string(MsgNews)
+	data.News.Articles = articles
+
+	return c.sendJson(ctx, customSendUri, &data)
+}
+
+func (c *Client) sendJson(ctx context.Context, uri string, v interface{}) error {
+	return c.postJson(ctx, uri, "", v, nil)
+}
+
+func (c *Client) getJson(ctx context.Context, uri, query string, respStruct interface{}) error {
+	data, err := c.call(ctx, "GET", uri, query, "", nil)
+	if err != nil {
+		return err
+	}
+	return unmarshal(data, respStruct)
+}
+
+func (c *Client) postJson(ctx context.Context, uri, query string, v, respStruct interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.post(ctx, uri, query, jsonContentType, body, respStruct)
+}
+
+func (c *Client) post(ctx context.Context, uri, query, bodyType string, body []byte, respStruct interface{}) error {
+	data, err := c.call(ctx, "POST", uri, query, bodyType, body)
+	if err != nil {
+		return err
+	}
+	return unmarshal(data, respStruct)
+}
+
+// call sends an API request with the access token and returns the response
+// body. If the token is rejected, it is refreshed and the request is
+// replayed once before the error is returned.
+func (c *Client) call(ctx context.Context, method, uri, query, bodyType string, body []byte) ([]byte, error) {
+	for retry := true; ; retry = false {
+		token, err := c.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		url := c.baseUrl + uri + "?access_token=" + token + query
+		data, err := c.request(ctx, method, url, bodyType, body)
+		if err != nil {
+			return nil, err
+		}
+
+		var result Error
+		if err := json.Unmarshal(data, &result); err != nil || result.Code == Success {
+			return data, nil
+		}
+		if !retry || !isTokenCode(result.Code) {
+			return nil, newAPIError(uri, result)
+		}
+
+		c.logger.Println(result.String(), "- refresh access token and retry")
+		if _, err := c.refreshToken(ctx, token); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func isTokenCode(code int) bool {
+	switch code {
+	case AppSecret, AccessTokenInvalid, AccessTokenTimeout:
+		return true
+	}
+	return false
+}
+
+func (c *Client) request(ctx context.Context, method, url, bodyType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(bodyType) > 0 {
+		req.Header.Set("Content-Type", bodyType)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func unmarshal(data []byte, respStruct interface{}) error {
+	if respStruct == nil {
+		return nil
+	}
+	return json.Unmarshal(data, respStruct)
+}
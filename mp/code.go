@@ -4,6 +4,7 @@ package mp
 import (
 	"errors"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -29,7 +30,7 @@ const (
 	AccessTokenInvalid                  // 14 不合法的access_token
 	MenuTypeInvalid                     // 15 不合法的菜单类型
 	ButtonNumInvalid                    // 16 不合法的按钮个数
-	ButtonTypeInvalid                   // 17 不合法的按钮个数
+	ButtonTypeInvalid                   // 17 不合法的按钮类型
 	ButtonNameLenInvalid                // 18 不合法的按钮名字长度
 	ButtonKeyLenInvalid                 // 19 不合法的按钮KEY长度
 	ButtonUrlLenInvalid                 // 20 不合法的按钮URL长度
@@ -138,9 +139,237 @@ func (err *Error) String() string {
 	return strconv.Itoa(err.Code) + ": " + err.Msg
 }
 
-func checkCode(err Error) error {
-	if err.Code != Success {
-		return errors.New(err.String())
+// APIError is the error returned by the API methods when the server
+// responds with a non-zero errcode, or when a request is known to be
+// rejected beforehand, e.g. by Menu.Validate.
+type APIError struct {
+	Code     int
+	Msg      string
+	Endpoint string // uri of the API, e.g. /user/info
+	Rid      string // request id to report to weixin
+}
+
+func (e *APIError) Error() string {
+	msg := e.Msg
+	if len(msg) == 0 {
+		msg = codeText[e.Code]
+	}
+	s := strconv.Itoa(e.Code) + ": " + msg
+	if len(e.Endpoint) > 0 {
+		s = e.Endpoint + ": " + s
+	}
+	return s
+}
+
+// Is reports whether target is an *APIError with the same code,
+// so that the sentinel errors below match any message.
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	return ok && t.Code == e.Code
+}
+
+// Sentinel errors for use with errors.Is, e.g. errors.Is(err, ErrUserNotExist).
+var (
+	ErrSystemBusy                  = &APIError{Code: SystemBusy}
+	ErrAppSecret                   = &APIError{Code: AppSecret}
+	ErrGrantTypeInvalid            = &APIError{Code: GrantTypeInvalid}
+	ErrOpenIDInvalid               = &APIError{Code: OpenIDInvalid}
+	ErrMediaTypeInvalid            = &APIError{Code: MediaTypeInvalid}
+	ErrFileTypeInvalid             = &APIError{Code: FileTypeInvalid}
+	ErrFileSizeInvalid             = &APIError{Code: FileSizeInvalid}
+	ErrMediaIdInvalid              = &APIError{Code: MediaIdInvalid}
+	ErrMsgTypeInvalid              = &APIError{Code: MsgTypeInvalid}
+	ErrImageSizeInvalid            = &APIError{Code: ImageSizeInvalid}
+	ErrAudioSizeInvalid            = &APIError{Code: AudioSizeInvalid}
+	ErrVideoSizeInvalid            = &APIError{Code: VideoSizeInvalid}
+	ErrThumbnailSizeInvalid        = &APIError{Code: ThumbnailSizeInvalid}
+	ErrAppIdInvalid                = &APIError{Code: AppIdInvalid}
+	ErrAccessTokenInvalid          = &APIError{Code: AccessTokenInvalid}
+	ErrMenuTypeInvalid             = &APIError{Code: MenuTypeInvalid}
+	ErrButtonNumInvalid            = &APIError{Code: ButtonNumInvalid}
+	ErrButtonTypeInvalid           = &APIError{Code: ButtonTypeInvalid}
+	ErrButtonNameLenInvalid        = &APIError{Code: ButtonNameLenInvalid}
+	ErrButtonKeyLenInvalid         = &APIError{Code: ButtonKeyLenInvalid}
+	ErrButtonUrlLenInvalid         = &APIError{Code: ButtonUrlLenInvalid}
+	ErrMenuVerInvalid              = &APIError{Code: MenuVerInvalid}
+	ErrSubMenuDegreeInvalid        = &APIError{Code: SubMenuDegreeInvalid}
+	ErrSubMenuButtonNumInvalid     = &APIError{Code: SubMenuButtonNumInvalid}
+	ErrSubMenuButtonTypeInvalid    = &APIError{Code: SubMenuButtonTypeInvalid}
+	ErrSubMenuButtonNameLenInvalid = &APIError{Code: SubMenuButtonNameLenInvalid}
+	ErrSubMenuButtonKeyLenInvalid  = &APIError{Code: SubMenuButtonKeyLenInvalid}
+	ErrSubMenuButtonUrlLenInvalid  = &APIError{Code: SubMenuButtonUrlLenInvalid}
+	ErrCustomMenuUserInvalid       = &APIError{Code: CustomMenuUserInvalid}
+	ErrOAuthCodeInvalid            = &APIError{Code: OAuthCodeInvalid}
+	ErrRefreshTokenInvalid         = &APIError{Code: RefreshTokenInvalid}
+	ErrOpenIdListInvalid           = &APIError{Code: OpenIdListInvalid}
+	ErrOpenIdListLenInvalid        = &APIError{Code: OpenIdListLenInvalid}
+	ErrCharacterInvalid            = &APIError{Code: CharacterInvalid}
+	ErrParamInvalid                = &APIError{Code: ParamInvalid}
+	ErrFormatInvalid               = &APIError{Code: FormatInvalid}
+	ErrUrlLenInvalid               = &APIError{Code: UrlLenInvalid}
+	ErrGroupIdInvalid              = &APIError{Code: GroupIdInvalid}
+	ErrGroupNameInvalid            = &APIError{Code: GroupNameInvalid}
+	ErrAccessTokenMissing          = &APIError{Code: AccessTokenMissing}
+	ErrAppIdMissing                = &APIError{Code: AppIdMissing}
+	ErrRefreshTokenMissing         = &APIError{Code: RefreshTokenMissing}
+	ErrSecretMissing               = &APIError{Code: SecretMissing}
+	ErrMediaMissing                = &APIError{Code: MediaMissing}
+	ErrMediaIdMissing              = &APIError{Code: MediaIdMissing}
+	ErrSubMenuMissing              = &APIError{Code: SubMenuMissing}
+	ErrOAuthCodeMissing            = &APIError{Code: OAuthCodeMissing}
+	ErrOpenIdMissing               = &APIError{Code: OpenIdMissing}
+	ErrAccessTokenTimeout          = &APIError{Code: AccessTokenTimeout}
+	ErrRefreshTokenTimeout         = &APIError{Code: RefreshTokenTimeout}
+	ErrOAuthCodeTimeout            = &APIError{Code: OAuthCodeTimeout}
+	ErrGetNeeded                   = &APIError{Code: GetNeeded}
+	ErrPostNeeded                  = &APIError{Code: PostNeeded}
+	ErrHttpsNeeded                 = &APIError{Code: HttpsNeeded}
+	ErrReceiverFollow              = &APIError{Code: ReceiverFollow}
+	ErrFriendNeeded                = &APIError{Code: FriendNeeded}
+	ErrMediaEmpty                  = &APIError{Code: MediaEmpty}
+	ErrPostEmpty                   = &APIError{Code: PostEmpty}
+	ErrImageMsgEmpty               = &APIError{Code: ImageMsgEmpty}
+	ErrTextMsgEmpty                = &APIError{Code: TextMsgEmpty}
+	ErrMediaSizeExceeded           = &APIError{Code: MediaSizeExceeded}
+	ErrMsgExceeded                 = &APIError{Code: MsgExceeded}
+	ErrTitleExceeded               = &APIError{Code: TitleExceeded}
+	ErrDescriptionExceeded         = &APIError{Code: DescriptionExceeded}
+	ErrUrlExceeded                 = &APIError{Code: UrlExceeded}
+	ErrImageUrlExceeded            = &APIError{Code: ImageUrlExceeded}
+	ErrAudioTimeExceeded           = &APIError{Code: AudioTimeExceeded}
+	ErrImageMsgExceeded            = &APIError{Code: ImageMsgExceeded}
+	ErrApiCallingExceeded          = &APIError{Code: ApiCallingExceeded}
+	ErrMenuNumExceeded             = &APIError{Code: MenuNumExceeded}
+	ErrReplyTimeExceeded           = &APIError{Code: ReplyTimeExceeded}
+	ErrSysGroupNotPermitted        = &APIError{Code: SysGroupNotPermitted}
+	ErrGroupNameTooLong            = &APIError{Code: GroupNameTooLong}
+	ErrGroupNumLimitExceeded       = &APIError{Code: GroupNumLimitExceeded}
+	ErrMediaNotExist               = &APIError{Code: MediaNotExist}
+	ErrMenuVerNotExist             = &APIError{Code: MenuVerNotExist}
+	ErrMenuDataExist               = &APIError{Code: MenuDataExist}
+	ErrUserNotExist                = &APIError{Code: UserNotExist}
+	ErrJsonXmlParser               = &APIError{Code: JsonXmlParser}
+	ErrApiUnauthorized             = &APIError{Code: ApiUnauthorized}
+	ErrApiUserUnauthorized         = &APIError{Code: ApiUserUnauthorized}
+)
+
+var codeText = map[int]string{
+	SystemBusy:                  "系统繁忙",
+	AppSecret:                   "获取access_token时AppSecret错误，或者access_token无效",
+	GrantTypeInvalid:            "不合法的凭证类型",
+	OpenIDInvalid:               "不合法的OpenID",
+	MediaTypeInvalid:            "不合法的媒体文件类型",
+	FileTypeInvalid:             "不合法的文件类型",
+	FileSizeInvalid:             "不合法的文件大小",
+	MediaIdInvalid:              "不合法的媒体文件id",
+	MsgTypeInvalid:              "不合法的消息类型",
+	ImageSizeInvalid:            "不合法的图片文件大小",
+	AudioSizeInvalid:            "不合法的语音文件大小",
+	VideoSizeInvalid:            "不合法的视频文件大小",
+	ThumbnailSizeInvalid:        "不合法的缩略图文件大小",
+	AppIdInvalid:                "不合法的APPID",
+	AccessTokenInvalid:          "不合法的access_token",
+	MenuTypeInvalid:             "不合法的菜单类型",
+	ButtonNumInvalid:            "不合法的按钮个数",
+	ButtonTypeInvalid:           "不合法的按钮类型",
+	ButtonNameLenInvalid:        "不合法的按钮名字长度",
+	ButtonKeyLenInvalid:         "不合法的按钮KEY长度",
+	ButtonUrlLenInvalid:         "不合法的按钮URL长度",
+	MenuVerInvalid:              "不合法的菜单版本号",
+	SubMenuDegreeInvalid:        "不合法的子菜单级数",
+	SubMenuButtonNumInvalid:     "不合法的子菜单按钮个数",
+	SubMenuButtonTypeInvalid:    "不合法的子菜单按钮类型",
+	SubMenuButtonNameLenInvalid: "不合法的子菜单按钮名字长度",
+	SubMenuButtonKeyLenInvalid:  "不合法的子菜单按钮KEY长度",
+	SubMenuButtonUrlLenInvalid:  "不合法的子菜单按钮URL长度",
+	CustomMenuUserInvalid:       "不合法的自定义菜单使用用户",
+	OAuthCodeInvalid:            "不合法的oauth_code",
+	RefreshTokenInvalid:         "不合法的refresh_token",
+	OpenIdListInvalid:           "不合法的openid列表",
+	OpenIdListLenInvalid:        "不合法的openid列表长度",
+	CharacterInvalid:            "不合法的请求字符，不能包含\\uxxxx格式的字符",
+	ParamInvalid:                "不合法的参数",
+	FormatInvalid:               "不合法的请求格式",
+	UrlLenInvalid:               "不合法的URL长度",
+	GroupIdInvalid:              "不合法的分组id",
+	GroupNameInvalid:            "分组名字不合法",
+	AccessTokenMissing:          "缺少access_token参数",
+	AppIdMissing:                "缺少appid参数",
+	RefreshTokenMissing:         "缺少refresh_token参数",
+	SecretMissing:               "缺少secret参数",
+	MediaMissing:                "缺少多媒体文件数据",
+	MediaIdMissing:              "缺少media_id参数",
+	SubMenuMissing:              "缺少子菜单数据",
+	OAuthCodeMissing:            "缺少oauth code",
+	OpenIdMissing:               "缺少openid",
+	AccessTokenTimeout:          "access_token超时",
+	RefreshTokenTimeout:         "refresh_token超时",
+	OAuthCodeTimeout:            "oauth_code超时",
+	GetNeeded:                   "需要GET请求",
+	PostNeeded:                  "需要POST请求",
+	HttpsNeeded:                 "需要HTTPS请求",
+	ReceiverFollow:              "需要接收者关注",
+	FriendNeeded:                "需要好友关系",
+	MediaEmpty:                  "多媒体文件为空",
+	PostEmpty:                   "POST的数据包为空",
+	ImageMsgEmpty:               "图文消息内容为空",
+	TextMsgEmpty:                "文本消息内容为空",
+	MediaSizeExceeded:           "多媒体文件大小超过限制",
+	MsgExceeded:                 "消息内容超过限制",
+	TitleExceeded:               "标题字段超过限制",
+	DescriptionExceeded:         "描述字段超过限制",
+	UrlExceeded:                 "链接字段超过限制",
+	ImageUrlExceeded:            "图片链接字段超过限制",
+	AudioTimeExceeded:           "语音播放时间超过限制",
+	ImageMsgExceeded:            "图文消息超过限制",
+	ApiCallingExceeded:          "接口调用超过限制",
+	MenuNumExceeded:             "创建菜单个数超过限制",
+	ReplyTimeExceeded:           "回复时间超过限制",
+	SysGroupNotPermitted:        "系统分组，不允许修改",
+	GroupNameTooLong:            "分组名字过长",
+	GroupNumLimitExceeded:       "分组数量超过上限",
+	MediaNotExist:               "不存在媒体数据",
+	MenuVerNotExist:             "不存在的菜单版本",
+	MenuDataExist:               "不存在的菜单数据",
+	UserNotExist:                "不存在的用户",
+	JsonXmlParser:               "解析JSON/XML内容错误",
+	ApiUnauthorized:             "api功能未授权",
+	ApiUserUnauthorized:         "用户未授权该api",
+}
+
+func newAPIError(uri string, err Error) *APIError {
+	e := &APIError{Code: err.Code, Msg: err.Msg, Endpoint: uri}
+	if i := strings.LastIndex(err.Msg, "rid:"); i >= 0 {
+		e.Rid = strings.TrimSpace(err.Msg[i+len("rid:"):])
+		e.Msg = strings.TrimSpace(err.Msg[:i])
+	}
+	return e
+}
+
+// IsTokenError reports whether err is caused by an invalid or
+// expired access token.
+func IsTokenError(err error) bool {
+	switch errorCode(err) {
+	case AppSecret, AccessTokenInvalid, AccessTokenMissing, AccessTokenTimeout:
+		return true
+	}
+	return false
+}
+
+// IsQuotaExceeded reports whether the api calling quota is used up.
+func IsQuotaExceeded(err error) bool {
+	return errorCode(err) == ApiCallingExceeded
+}
+
+// IsRetryable reports whether the same request may succeed if sent again.
+func IsRetryable(err error) bool {
+	return errorCode(err) == SystemBusy || IsTokenError(err)
+}
+
+func errorCode(err error) int {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e.Code
 	}
-	return nil
+	return Success
 }
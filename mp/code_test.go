@@ -0,0 +1,33 @@
+// code_test.go
+package mp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAPIError(t *testing.T) {
+	err := error(newAPIError(userInfoUri, Error{Code: UserNotExist,
+		Msg: "invalid openid rid: 5f3b2a1c-0b1e2d3f"}))
+	err = fmt.Errorf("enrich: %w", err)
+
+	if !errors.Is(err, ErrUserNotExist) || errors.Is(err, ErrApiCallingExceeded) {
+		t.Fatal("errors.Is mismatch")
+	}
+
+	var e *APIError
+	if !errors.As(err, &e) {
+		t.Fatal("errors.As failed")
+	}
+	if e.Rid != "5f3b2a1c-0b1e2d3f" || e.Msg != "invalid openid" || e.Endpoint != userInfoUri {
+		t.Fatalf("unexpected %+v", e)
+	}
+
+	if IsTokenError(err) || IsRetryable(err) || IsQuotaExceeded(err) {
+		t.Fatal("unexpected classification")
+	}
+	if !IsQuotaExceeded(ErrApiCallingExceeded) || !IsRetryable(ErrAccessTokenTimeout) {
+		t.Fatal("unexpected classification")
+	}
+}
@@ -0,0 +1,70 @@
+// context
+package mp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Context carries everything about a callback message to its handler.
+// The embedded context.Context is the one of the HTTP request.
+type Context struct {
+	context.Context
+	Replyer
+
+	Request *http.Request
+	Message *Message
+	Raw     []byte // plaintext XML of the message
+
+	Server *Server
+	Client *Client // nil if the Server runs without a Client
+
+	reply *messageReply
+	keys  map[string]interface{}
+}
+
+type ContextFunc func(c *Context)
+
+// Adapt turns a HandlerFunc into a ContextFunc.
+func Adapt(handler HandlerFunc) ContextFunc {
+	return func(c *Context) {
+		handler(c.Replyer, c.Message)
+	}
+}
+
+// Set stores a value for the lifetime of the request, e.g. to pass
+// data from a middleware to the handler.
+func (c *Context) Set(key string, value interface{}) {
+	if c.keys == nil {
+		c.keys = make(map[string]interface{})
+	}
+	c.keys[key] = value
+}
+
+func (c *Context) Get(key string) (value interface{}, ok bool) {
+	value, ok = c.keys[key]
+	return
+}
+
+// DownloadMedia downloads the media of an image, voice, video or
+// shortvideo message, thumb selects the thumbnail of a video instead.
+func (c *Context) DownloadMedia(thumb bool) (io.Reader, error) {
+	if c.Client == nil {
+		return nil, ErrNoClient
+	}
+	mediaId := c.Message.MediaId
+	if thumb {
+		mediaId = c.Message.ThumbMediaId
+	}
+	if len(mediaId) == 0 {
+		return nil, errors.New("no media in " + c.Message.Type + " message")
+	}
+	return c.Client.DownloadMediaContext(c, mediaId)
+}
+
+// Replied reports whether a reply has been written.
+func (c *Context) Replied() bool {
+	return c.reply != nil && c.reply.isReplied()
+}
@@ -0,0 +1,191 @@
+// crypt
+package mp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// CryptMode is the message encryption mode configured in the
+// developer console (消息加解密方式).
+type CryptMode int
+
+const (
+	CryptPlain      CryptMode = iota // 明文模式
+	CryptCompatible                  // 兼容模式
+	CryptSafe                        // 安全模式
+)
+
+const (
+	encodingAESKeyLen = 43
+	cryptBlockSize    = 32
+)
+
+var (
+	ErrAESKeyInvalid    = errors.New("invalid EncodingAESKey")
+	ErrCipherInvalid    = errors.New("invalid encrypted message")
+	ErrAppIdMismatch    = errors.New("appid of encrypted message mismatch")
+	ErrSignatureInvalid = errors.New("invalid signature")
+)
+
+// MsgCrypter encrypts and decrypts callback messages with the
+// EncodingAESKey, it can be used with any HTTP framework.
+type MsgCrypter struct {
+	appId string
+	token string
+	key   []byte
+}
+
+func NewMsgCrypter(appId, token, encodingAESKey string) (*MsgCrypter, error) {
+	if len(encodingAESKey) != encodingAESKeyLen {
+		return nil, ErrAESKeyInvalid
+	}
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil || len(key) != 32 {
+		return nil, ErrAESKeyInvalid
+	}
+
+	return &MsgCrypter{appId: appId, token: token, key: key}, nil
+}
+
+// Signature computes msg_signature: sha1 of the sorted token, timestamp,
+// nonce and encrypted message.
+func (c *MsgCrypter) Signature(timestamp, nonce, encrypt string) string {
+	list := []string{c.token, timestamp, nonce, encrypt}
+	sort.Strings(list)
+
+	h := sha1.New()
+	io.WriteString(h, strings.Join(list, ""))
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Encrypt packs msg as random(16) + len(msg)(4, big endian) + msg + appId,
+// pads it with PKCS#7 and encrypts it with AES-256-CBC.
+func (c *MsgCrypter) Encrypt(msg []byte) (string, error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.CopyN(buf, rand.Reader, 16); err != nil {
+		return "", err
+	}
+	binary.Write(buf, binary.BigEndian, uint32(len(msg)))
+	buf.Write(msg)
+	buf.WriteString(c.appId)
+
+	plain := pkcs7Pad(buf.Bytes(), cryptBlockSize)
+
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, c.key[:aes.BlockSize]).CryptBlocks(data, plain)
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (c *MsgCrypter) Decrypt(encrypt string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypt)
+	if err != nil {
+		return nil, ErrCipherInvalid
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, ErrCipherInvalid
+	}
+
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, c.key[:aes.BlockSize]).CryptBlocks(plain, data)
+
+	if plain, err = pkcs7Unpad(plain, cryptBlockSize); err != nil {
+		return nil, err
+	}
+	if len(plain) < 20 {
+		return nil, ErrCipherInvalid
+	}
+
+	n := int(binary.BigEndian.Uint32(plain[16:20]))
+	if n < 0 || 20+n > len(plain) {
+		return nil, ErrCipherInvalid
+	}
+	if string(plain[20+n:]) != c.appId {
+		return nil, ErrAppIdMismatch
+	}
+
+	return plain[20 : 20+n], nil
+}
+
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	return append(data, bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrCipherInvalid
+	}
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, ErrCipherInvalid
+	}
+	return data[:len(data)-n], nil
+}
+
+// encryptedMsg is the envelope of an encrypted message
+// in both directions.
+type encryptedMsg struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   string   `xml:",omitempty"`
+	Encrypt      string
+	MsgSignature string `xml:",omitempty"`
+	TimeStamp    string `xml:",omitempty"`
+	Nonce        string `xml:",omitempty"`
+}
+
+// DecryptMessage verifies msg_signature of the encrypted message data
+// and returns the plaintext XML.
+func DecryptMessage(c *MsgCrypter, msgSignature, timestamp, nonce string, data []byte) ([]byte, error) {
+	var env encryptedMsg
+	if err := xml.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	if len(env.Encrypt) == 0 {
+		return nil, ErrCipherInvalid
+	}
+
+	if c.Signature(timestamp, nonce, env.Encrypt) != msgSignature {
+		return nil, ErrSignatureInvalid
+	}
+
+	return c.Decrypt(env.Encrypt)
+}
+
+// EncryptMessage wraps the plaintext XML data into a signed
+// encrypted message.
+func EncryptMessage(c *MsgCrypter, timestamp, nonce string, data []byte) ([]byte, error) {
+	encrypt, err := c.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	env := encryptedMsg{
+		Encrypt:      encrypt,
+		MsgSignature: c.Signature(timestamp, nonce, encrypt),
+		TimeStamp:    timestamp,
+		Nonce:        nonce,
+	}
+	return xml.Marshal(&env)
+}
@@ -0,0 +1,128 @@
+// crypt_test.go
+package mp
+
+import (
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testAESKey = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+
+func TestCryptRoundTrip(t *testing.T) {
+	c, err := NewMsgCrypter("wxappid", "token", testAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("<xml><Content>你好</Content></xml>")
+	encrypt, err := c.Encrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := c.Decrypt(encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != string(msg) {
+		t.Fatalf("got %q, want %q", plain, msg)
+	}
+
+	other, _ := NewMsgCrypter("wxother", "token", testAESKey)
+	if _, err := other.Decrypt(encrypt); err != ErrAppIdMismatch {
+		t.Fatalf("got %v, want ErrAppIdMismatch", err)
+	}
+
+	if _, err := NewMsgCrypter("wxappid", "token", "short"); err != ErrAESKeyInvalid {
+		t.Fatalf("got %v, want ErrAESKeyInvalid", err)
+	}
+}
+
+// TestDecryptSample decrypts the message of the official sample code.
+func TestDecryptSample(t *testing.T) {
+	c, err := NewMsgCrypter("wx2c2769f8efd9abc2", "spamtest", testAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := "hyzAe4OzmOMbd6TvGdIOO6uBmdJoD0Fk53REIHvxYtJlE2B655HuD0m8KUePWB3+LrPXo87wzQ1QLvbeUgmBM4x6F8PGHQHFVAFmOD2LdJF9FrXpbUAh0B5GIItb52sn896wVsMSHGuPE328HnRGBcrS7C41IzDWyWNlZkyyXwon8T332jisa+h6tEDYsVticbSnyU8dKOIbgU6ux5VTjg3yt+WGzjlpKn6NPhRjpA912xMezR4kw6KWwMrCVKSVCZciVGCgavjIQ6X8tCOp3yZbGpy0VxpAe+77TszTfRd5RJSVO/HTnifJpXgCSUdUue1v6h0EIBYYI1BD1DlD+C0CR8e6OewpusjZ4uBl9FyJvnhvQl+q5rv1ixrcpCumEPo5MJSgM9ehVsNPfUM669WuMyVWQLCzpu9GhglF2PE="
+	data, err := c.Decrypt(encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Message
+	if err := xml.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ToUserName != "gh_10f6c3c3ac5a" || m.FromUserName != "oyORnuP8q7ou2gfYjqLzSIWZf0rs" ||
+		m.CreateTime != 1409735668 || m.Content != "abcdteT" || m.MsgId != 6054768590064713728 {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestServeEncrypted(t *testing.T) {
+	mp := New("wxappid", "secret", "token", WithEncodingAESKey(testAESKey, CryptSafe))
+	mp.HandleFunc(MsgText, func(reply Replyer, m *Message) {
+		reply.ReplyText("echo: " + m.Content)
+	})
+
+	plain := "<xml><ToUserName>gh_1</ToUserName><FromUserName>user</FromUserName>" +
+		"<CreateTime>1</CreateTime><MsgType>text</MsgType><Content>hi</Content></xml>"
+	encrypt, err := mp.crypter.Encrypt([]byte(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "<xml><ToUserName>gh_1</ToUserName><Encrypt>" + encrypt + "</Encrypt></xml>"
+
+	timestamp, nonce := "1409304348", "xxxxxx"
+	q := url.Values{}
+	q.Set("signature", checkSignatureOf("token", timestamp, nonce))
+	q.Set("timestamp", timestamp)
+	q.Set("nonce", nonce)
+	q.Set("encrypt_type", "aes")
+	q.Set("msg_signature", mp.crypter.Signature(timestamp, nonce, encrypt))
+
+	w := httptest.NewRecorder()
+	mp.ServeHTTP(w, httptest.NewRequest("POST", "/?"+q.Encode(), strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	var env encryptedMsg
+	if err := xml.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.MsgSignature != mp.crypter.Signature(env.TimeStamp, env.Nonce, env.Encrypt) {
+		t.Fatal("reply signature mismatch")
+	}
+	data, err := mp.crypter.Decrypt(env.Encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply Message
+	if err := xml.Unmarshal(data, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Content != "echo: hi" || reply.ToUserName != "user" {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+
+	// plaintext bodies are rejected in safe mode
+	q.Del("encrypt_type")
+	w = httptest.NewRecorder()
+	mp.ServeHTTP(w, httptest.NewRequest("POST", "/?"+q.Encode(), strings.NewReader(plain)))
+	if w.Code != 400 {
+		t.Fatalf("status %d, want 400", w.Code)
+	}
+}
+
+func checkSignatureOf(token, timestamp, nonce string) string {
+	list := []string{token, timestamp, nonce}
+	sort.Strings(list)
+	return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(list, ""))))
+}
@@ -0,0 +1,121 @@
+// dedup
+package mp
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupSize = 10000
+	defaultDedupTTL  = time.Minute
+)
+
+type DedupMode int
+
+const (
+	DedupReplay DedupMode = iota // answer retries with the reply of the first attempt
+	DedupDrop                    // answer retries with an empty response
+)
+
+// DedupStore remembers the callbacks already handled, weixin retries
+// a callback three times if it is not answered within 5 seconds.
+type DedupStore interface {
+	// Claim marks key as seen. It reports whether key was seen before,
+	// and the reply stored for it, if any.
+	Claim(key string) (reply []byte, seen bool)
+	// Store saves the reply written for key.
+	Store(key string, reply []byte)
+	// Release forgets key, so that a retry is handled again.
+	Release(key string)
+}
+
+type dedupEntry struct {
+	key    string
+	reply  []byte
+	expire time.Time
+}
+
+// MemoryDedupStore is a LRU DedupStore, whose entries expire after ttl.
+type MemoryDedupStore struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	if size <= 0 {
+		size = defaultDedupSize
+	}
+	if ttl <= 0 {
+		ttl = defaultDedupTTL
+	}
+	return &MemoryDedupStore{size: size, ttl: ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element)}
+}
+
+func (s *MemoryDedupStore) Claim(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if e, ok := s.items[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		if now.Before(entry.expire) {
+			s.ll.MoveToFront(e)
+			return entry.reply, true
+		}
+		s.remove(e)
+	}
+
+	s.items[key] = s.ll.PushFront(&dedupEntry{key: key, expire: now.Add(s.ttl)})
+	for s.ll.Len() > s.size {
+		s.remove(s.ll.Back())
+	}
+	return nil, false
+}
+
+func (s *MemoryDedupStore) Store(key string, reply []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		e.Value.(*dedupEntry).reply = reply
+	}
+}
+
+func (s *MemoryDedupStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+	}
+}
+
+func (s *MemoryDedupStore) remove(e *list.Element) {
+	s.ll.Remove(e)
+	delete(s.items, e.Value.(*dedupEntry).key)
+}
+
+// dedupKey identifies a message by MsgId, or by
+// FromUserName+CreateTime+Event+EventKey for events which have no MsgId.
+func dedupKey(m *Message) string {
+	if m.MsgId != 0 {
+		return "msg:" + strconv.FormatUint(m.MsgId, 10)
+	}
+	return "event:" + m.FromUserName + ":" +
+		strconv.FormatInt(m.CreateTime, 10) + ":" + m.Event + ":" + m.EventKey
+}
+
+// SetDedup sets the store used to detect retried callbacks, nil
+// disables deduplication. Default is a MemoryDedupStore in DedupReplay mode.
+func (srv *Server) SetDedup(store DedupStore, mode DedupMode) {
+	srv.dedup = store
+	srv.dedupMode = mode
+}
@@ -0,0 +1,111 @@
+// dedup_test.go
+package mp
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupReplay(t *testing.T) {
+	mp := New("appid", "secret", "token")
+
+	n := 0
+	mp.HandleFunc(MsgText, func(reply Replyer, m *Message) {
+		n++
+		reply.ReplyText("points +1")
+	})
+
+	body := "<xml><ToUserName>gh_1</ToUserName><FromUserName>user</FromUserName>" +
+		"<CreateTime>1</CreateTime><MsgType>text</MsgType><Content>sign in</Content>" +
+		"<MsgId>1234567890</MsgId></xml>"
+
+	first := httptest.NewRecorder()
+	mp.ServeHTTP(first, callbackRequest("token", body))
+	retry := httptest.NewRecorder()
+	mp.ServeHTTP(retry, callbackRequest("token", body))
+
+	if n != 1 {
+		t.Fatalf("handler called %d times", n)
+	}
+	if first.Body.Len() == 0 || retry.Body.String() != first.Body.String() {
+		t.Fatalf("retry got %q, want %q", retry.Body, first.Body)
+	}
+
+	mp.SetDedup(NewMemoryDedupStore(1, time.Minute), DedupDrop)
+	mp.ServeHTTP(httptest.NewRecorder(), callbackRequest("token", body))
+	retry = httptest.NewRecorder()
+	mp.ServeHTTP(retry, callbackRequest("token", body))
+	if n != 2 || retry.Body.Len() != 0 {
+		t.Fatalf("handler called %d times, retry got %q", n, retry.Body)
+	}
+}
+
+func TestDedupEventKey(t *testing.T) {
+	mp := New("appid", "secret", "token")
+
+	var keys []string
+	mp.KeyFunc("V1001", func(reply Replyer, m *Message) { keys = append(keys, m.EventKey) })
+	mp.KeyFunc("V1002", func(reply Replyer, m *Message) { keys = append(keys, m.EventKey) })
+
+	click := func(key string) string {
+		return "<xml><ToUserName>gh_1</ToUserName><FromUserName>user</FromUserName>" +
+			"<CreateTime>1</CreateTime><MsgType>event</MsgType><Event>CLICK</Event>" +
+			"<EventKey>" + key + "</EventKey></xml>"
+	}
+	mp.ServeHTTP(httptest.NewRecorder(), callbackRequest("token", click("V1001")))
+	mp.ServeHTTP(httptest.NewRecorder(), callbackRequest("token", click("V1002")))
+	mp.ServeHTTP(httptest.NewRecorder(), callbackRequest("token", click("V1002")))
+
+	if len(keys) != 2 || keys[0] != "V1001" || keys[1] != "V1002" {
+		t.Fatalf("handled %v, want [V1001 V1002]", keys)
+	}
+}
+
+func TestDedupPanic(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Second} {
+		mp := New("appid", "secret", "token", WithLogger(testLogger{t}))
+		mp.SetReplyTimeout(timeout)
+
+		n := 0
+		mp.HandleFunc(MsgText, func(reply Replyer, m *Message) {
+			if n++; n == 1 {
+				panic("boom")
+			}
+			reply.ReplyText("points +1")
+		})
+
+		body := "<xml><ToUserName>gh_1</ToUserName><FromUserName>user</FromUserName>" +
+			"<CreateTime>1</CreateTime><MsgType>text</MsgType><Content>sign in</Content>" +
+			"<MsgId>1234567890</MsgId></xml>"
+		func() {
+			defer func() {
+				if err := recover(); err == nil {
+					t.Error("panic not raised")
+				}
+			}()
+			mp.ServeHTTP(httptest.NewRecorder(), callbackRequest("token", body))
+		}()
+
+		retry := httptest.NewRecorder()
+		mp.ServeHTTP(retry, callbackRequest("token", body))
+		if n != 2 || !strings.Contains(retry.Body.String(), "points +1") {
+			t.Fatalf("timeout %v: handler called %d times, retry got %q", timeout, n, retry.Body)
+		}
+	}
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	s := NewMemoryDedupStore(2, 20*time.Millisecond)
+	s.Claim("a")
+	s.Claim("b")
+	s.Claim("c") // evicts a
+	if _, seen := s.Claim("a"); seen {
+		t.Fatal("a should have been evicted")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, seen := s.Claim("c"); seen {
+		t.Fatal("c should have expired")
+	}
+}
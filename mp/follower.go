@@ -0,0 +1,196 @@
+// follower
+package mp
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FollowerIterator walks the openids of all followers, page by page:
+//
+//	it := c.FollowerIter(ctx, "")
+//	for it.Next() {
+//		openId := it.OpenId()
+//	}
+//	if err := it.Err(); err != nil {
+//		// resume later with c.FollowerIter(ctx, it.Checkpoint())
+//	}
+type FollowerIterator struct {
+	c     *Client
+	ctx   context.Context
+	ids   []string
+	start string
+	id    string
+	total int
+	done  bool
+	err   error
+}
+
+// FollowerIter returns an iterator over the followers after the openid
+// start, or from the first one if start is empty.
+func (c *Client) FollowerIter(ctx context.Context, start string) *FollowerIterator {
+	return &FollowerIterator{c: c, ctx: ctx, start: start, id: start}
+}
+
+func (it *FollowerIterator) Next() bool {
+	for len(it.ids) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+
+		total, ids, next, err := it.c.FollowersContext(it.ctx, it.start)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.total = total
+		// the last page returns the last openid as next_openid, the
+		// request after it returns no openids
+		if len(ids) == 0 || len(next) == 0 || next == it.start {
+			it.done = true
+		}
+		it.ids = ids
+		it.start = next
+	}
+
+	it.id = it.ids[0]
+	it.ids = it.ids[1:]
+	return true
+}
+
+func (it *FollowerIterator) OpenId() string {
+	return it.id
+}
+
+// Total is the number of followers, known after the first call of Next.
+func (it *FollowerIterator) Total() int {
+	return it.total
+}
+
+// Checkpoint is the last openid returned, FollowerIter resumes after it.
+func (it *FollowerIterator) Checkpoint() string {
+	return it.id
+}
+
+func (it *FollowerIterator) Err() error {
+	return it.err
+}
+
+// StreamFollowers sends the openids of the followers after start to the
+// returned channel, which is closed at the end. The error channel
+// receives the error which stopped the walk, if any.
+func (c *Client) StreamFollowers(ctx context.Context, start string) (<-chan string, <-chan error) {
+	ids := make(chan string)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(ids)
+		defer close(errc)
+
+		it := c.FollowerIter(ctx, start)
+		for it.Next() {
+			select {
+			case ids <- it.OpenId():
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			errc <- err
+		}
+	}()
+
+	return ids, errc
+}
+
+type ExportFormat int
+
+const (
+	ExportJSONLines ExportFormat = iota // one JSON User per line
+	ExportCSV                           // with a header line
+)
+
+var csvHeader = []string{"openid", "subscribe", "nickname", "sex", "language",
+	"city", "province", "country", "headimgurl", "subscribe_time",
+	"remark", "tagid_list", "subscribe_scene", "qr_scene", "qr_scene_str"}
+
+func csvRecord(u *User) []string {
+	tags := make([]string, len(u.TagIdList))
+	for i, id := range u.TagIdList {
+		tags[i] = strconv.Itoa(id)
+	}
+	return []string{u.OpenId, strconv.Itoa(u.Subscribe), u.Nickname,
+		strconv.Itoa(u.Sex), u.Language, u.City, u.Province, u.Country,
+		u.HeadImgUrl, strconv.FormatInt(u.SubscribeTime, 10),
+		u.Remark, strings.Join(tags, " "), u.SubscribeScene,
+		strconv.Itoa(u.QrScene), u.QrSceneStr}
+}
+
+// ExportFollowers writes the info of the followers after start to w. It
+// returns the last openid written, to resume from if err is not nil.
+func (c *Client) ExportFollowers(ctx context.Context, w io.Writer, format ExportFormat,
+	start string, lang LangType) (last string, err error) {
+
+	var write func(u *User) error
+	switch format {
+	case ExportJSONLines:
+		enc := json.NewEncoder(w)
+		write = func(u *User) error { return enc.Encode(u) }
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		defer func() {
+			cw.Flush()
+			if err == nil {
+				err = cw.Error()
+			}
+		}()
+		if len(start) == 0 {
+			if err = cw.Write(csvHeader); err != nil {
+				return
+			}
+		}
+		write = func(u *User) error { return cw.Write(csvRecord(u)) }
+	default:
+		return start, fmt.Errorf("unknown export format %d", format)
+	}
+
+	last = start
+	flush := func(openIds []string) error {
+		users, err := c.UsersInfoContext(ctx, openIds, lang)
+		if err != nil {
+			return err
+		}
+		for i := range users {
+			if err := write(&users[i]); err != nil {
+				return err
+			}
+		}
+		last = openIds[len(openIds)-1]
+		return nil
+	}
+
+	var openIds []string
+	it := c.FollowerIter(ctx, start)
+	for it.Next() {
+		openIds = append(openIds, it.OpenId())
+		if len(openIds) == maxBatchUsers {
+			if err = flush(openIds); err != nil {
+				return
+			}
+			openIds = openIds[:0]
+		}
+	}
+	if err = it.Err(); err != nil {
+		return
+	}
+	if len(openIds) > 0 {
+		err = flush(openIds)
+	}
+	return
+}
@@ -0,0 +1,385 @@
+// follower store
+package mp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FollowerStore keeps the profiles of the followers, see FollowerSyncer.
+type FollowerStore interface {
+	Get(openId string) (user User, ok bool, err error)
+	Put(users ...User) error
+	Delete(openIds ...string) error
+	// Range calls f for every follower until f returns false.
+	Range(f func(u *User) bool) error
+}
+
+// SubscribedSince returns the followers subscribed since t, the most recent first.
+func SubscribedSince(store FollowerStore, t time.Time) ([]User, error) {
+	users, err := findFollowers(store, func(u *User) bool {
+		return u.SubscribeTime >= t.Unix()
+	})
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].SubscribeTime > users[j].SubscribeTime
+	})
+	return users, err
+}
+
+func FollowersByTag(store FollowerStore, tagId int) ([]User, error) {
+	return findFollowers(store, func(u *User) bool {
+		for _, id := range u.TagIdList {
+			if id == tagId {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FollowersByLanguage returns the followers whose language is lang, e.g. zh_CN.
+func FollowersByLanguage(store FollowerStore, lang string) ([]User, error) {
+	return findFollowers(store, func(u *User) bool {
+		return u.Language == lang
+	})
+}
+
+func findFollowers(store FollowerStore, match func(u *User) bool) (users []User, err error) {
+	err = store.Range(func(u *User) bool {
+		if match(u) {
+			users = append(users, *u)
+		}
+		return true
+	})
+	return
+}
+
+type MemoryFollowerStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func NewMemoryFollowerStore() *MemoryFollowerStore {
+	return &MemoryFollowerStore{users: make(map[string]User)}
+}
+
+func (s *MemoryFollowerStore) Get(openId string) (User, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[openId]
+	return u, ok, nil
+}
+
+func (s *MemoryFollowerStore) Put(users ...User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range users {
+		s.users[u.OpenId] = u
+	}
+	return nil
+}
+
+func (s *MemoryFollowerStore) Delete(openIds ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range openIds {
+		delete(s.users, id)
+	}
+	return nil
+}
+
+// Range iterates over a snapshot, so f may modify the store.
+func (s *MemoryFollowerStore) Range(f func(u *User) bool) error {
+	s.mu.RLock()
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.mu.RUnlock()
+
+	for i := range users {
+		if !f(&users[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// followerRecord is a line of the log of FileFollowerStore.
+type followerRecord struct {
+	User   *User  `json:"user,omitempty"`
+	Delete string `json:"delete,omitempty"`
+}
+
+// FileFollowerStore is a MemoryFollowerStore persisted to a file, where
+// every change is appended as a JSON line. Compact rewrites the file
+// with only the current followers.
+type FileFollowerStore struct {
+	*MemoryFollowerStore
+
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// OpenFileFollowerStore loads the followers of the file path, which is
+// created if it does not exist.
+func OpenFileFollowerStore(path string) (*FileFollowerStore, error) {
+	s := &FileFollowerStore{MemoryFollowerStore: NewMemoryFollowerStore(), path: path}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var r followerRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// a partial last line, left by a crash while writing
+			continue
+		}
+		if r.User != nil {
+			s.MemoryFollowerStore.Put(*r.User)
+		}
+		if len(r.Delete) > 0 {
+			s.MemoryFollowerStore.Delete(r.Delete)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s.f = f
+	return s, nil
+}
+
+func (s *FileFollowerStore) Put(users ...User) error {
+	records := make([]followerRecord, len(users))
+	for i := range users {
+		records[i].User = &users[i]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(records); err != nil {
+		return err
+	}
+	return s.MemoryFollowerStore.Put(users...)
+}
+
+func (s *FileFollowerStore) Delete(openIds ...string) error {
+	records := make([]followerRecord, len(openIds))
+	for i, id := range openIds {
+		records[i].Delete = id
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(records); err != nil {
+		return err
+	}
+	return s.MemoryFollowerStore.Delete(openIds...)
+}
+
+// append writes records to the file, s.mu must be held.
+func (s *FileFollowerStore) append(records []followerRecord) error {
+	var buf []byte
+	for i := range records {
+		data, err := json.Marshal(&records[i])
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+
+	_, err := s.f.Write(buf)
+	return err
+}
+
+// Compact rewrites the file with the current followers only.
+func (s *FileFollowerStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf bytes.Buffer
+	var err error
+	enc := json.NewEncoder(&buf)
+	s.MemoryFollowerStore.Range(func(u *User) bool {
+		err = enc.Encode(&followerRecord{User: u})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(s.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	nf, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = nf
+	return nil
+}
+
+func (s *FileFollowerStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// FollowerSyncer keeps a FollowerStore in sync with the followers of
+// the official account, by a full Reconcile and by the subscribe and
+// unsubscribe events seen by the router it is attached to. The events
+// are applied in order, after a running Reconcile.
+type FollowerSyncer struct {
+	client *Client
+	store  FollowerStore
+	lang   LangType
+	conf   BatchConfig
+
+	mu   sync.Mutex // serializes Reconcile and the events
+	qmu  sync.Mutex
+	last chan struct{} // closed once the last event is applied
+	wg   sync.WaitGroup
+}
+
+func NewFollowerSyncer(client *Client, store FollowerStore, lang LangType) *FollowerSyncer {
+	return &FollowerSyncer{client: client, store: store, lang: lang}
+}
+
+// SetBatchConfig sets the concurrency and rate limit of Reconcile.
+func (s *FollowerSyncer) SetBatchConfig(conf BatchConfig) {
+	s.conf = conf
+}
+
+// Reconcile loads the info of all followers into the store, and deletes
+// the users who are not following anymore.
+func (s *FollowerSyncer) Reconcile(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var openIds []string
+	it := s.client.FollowerIter(ctx, "")
+	for it.Next() {
+		openIds = append(openIds, it.OpenId())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	for batch := range s.client.BatchUserInfo(ctx, openIds, s.lang, s.conf) {
+		if batch.Err != nil {
+			return batch.Err
+		}
+		if err := s.store.Put(batch.Users...); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	following := make(map[string]bool, len(openIds))
+	for _, id := range openIds {
+		following[id] = true
+	}
+	var gone []string
+	err := s.store.Range(func(u *User) bool {
+		if !following[u.OpenId] {
+			gone = append(gone, u.OpenId)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(gone) > 0 {
+		if err := s.store.Delete(gone...); err != nil {
+			return err
+		}
+	}
+
+	if store, ok := s.store.(interface{ Compact() error }); ok {
+		return store.Compact()
+	}
+	return nil
+}
+
+// Attach applies the subscribe and unsubscribe events routed by router
+// to the store, after the handlers registered for them.
+func (s *FollowerSyncer) Attach(router *Router) {
+	router.Use(s.Middleware())
+}
+
+// Middleware is the middleware used by Attach.
+func (s *FollowerSyncer) Middleware() Middleware {
+	return func(next ContextFunc) ContextFunc {
+		return func(c *Context) {
+			next(c)
+
+			m := c.Message
+			if m.Type != string(MsgEvent) {
+				return
+			}
+			ctx, openId := context.WithoutCancel(c), m.FromUserName
+			switch EventType(m.Event) {
+			case EventSubscribe:
+				s.apply(openId, func() error {
+					user, err := s.client.UserInfoContext(ctx, openId, s.lang)
+					if err != nil {
+						return err
+					}
+					return s.store.Put(user)
+				})
+			case EventUnsubscribe:
+				s.apply(openId, func() error {
+					return s.store.Delete(openId)
+				})
+			}
+		}
+	}
+}
+
+// apply runs f in the background, so that the reply is not delayed,
+// after the previous events and any running Reconcile.
+func (s *FollowerSyncer) apply(openId string, f func() error) {
+	s.qmu.Lock()
+	prev := s.last
+	done := make(chan struct{})
+	s.last = done
+	s.qmu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := f(); err != nil {
+			s.client.logger.Println("sync follower", openId, "failed:", err)
+		}
+	}()
+}
+
+// Wait waits for the events received so far to be applied to the store,
+// e.g. before closing it.
+func (s *FollowerSyncer) Wait() {
+	s.wg.Wait()
+}
@@ -0,0 +1,128 @@
+// follower_store_test.go
+package mp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFollowerSyncer(t *testing.T) {
+	mux := followersMux(3, 10)
+	mux.HandleFunc(userInfoUri, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&User{OpenId: r.FormValue("openid"), Subscribe: 1,
+			Language: "en", SubscribeTime: time.Now().Unix(), TagIdList: []int{2}})
+	})
+	c := newTestClient(t, mux)
+
+	path := filepath.Join(t.TempDir(), "followers.jsonl")
+	store, err := OpenFileFollowerStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put(User{OpenId: "gone"})
+
+	s := NewFollowerSyncer(c, store, LangCN)
+	if err := s.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get("gone"); ok {
+		t.Error("unfollowed user not deleted")
+	}
+	if u, ok, _ := store.Get("o2"); !ok || u.Nickname != "n-o2" {
+		t.Errorf("o2 %+v, %v", u, ok)
+	}
+
+	router := NewRouter()
+	s.Attach(router)
+	subscribed := false
+	router.EventFunc(EventSubscribe, func(reply Replyer, m *Message) { subscribed = true })
+
+	event := func(event, from string) {
+		m := &Message{MsgHeader: MsgHeader{Type: "event", FromUserName: from}, Event: event}
+		router.handler()(&Context{Context: context.Background(), Message: m})
+	}
+	event("subscribe", "o9")
+	event("unsubscribe", "o0")
+	s.Wait()
+
+	if !subscribed {
+		t.Error("subscribe handler overridden")
+	}
+	if users, _ := SubscribedSince(store, time.Now().Add(-time.Minute)); len(users) != 1 ||
+		users[0].OpenId != "o9" {
+		t.Errorf("subscribed since %+v", users)
+	}
+	if users, _ := FollowersByTag(store, 2); len(users) != 1 {
+		t.Errorf("by tag %+v", users)
+	}
+	if users, _ := FollowersByLanguage(store, "en"); len(users) != 1 {
+		t.Errorf("by language %+v", users)
+	}
+	store.Close()
+
+	store, err = OpenFileFollowerStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var ids []string
+	store.Range(func(u *User) bool {
+		ids = append(ids, u.OpenId)
+		return true
+	})
+	if len(ids) != 3 {
+		t.Errorf("reloaded %v", ids)
+	}
+	if _, ok, _ := store.Get("o0"); ok {
+		t.Error("o0 not deleted after reload")
+	}
+}
+
+func TestFollowerSyncerEventsDuringReconcile(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	list := followersMux(3, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc(followersUri, func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("next_openid") == "" {
+			close(started)
+			<-release
+		}
+		list.ServeHTTP(w, r)
+	})
+	mux.Handle(userBatchGetUri, list)
+	mux.HandleFunc(userInfoUri, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&User{OpenId: r.FormValue("openid"), Subscribe: 1})
+	})
+	c := newTestClient(t, mux)
+
+	store := NewMemoryFollowerStore()
+	s := NewFollowerSyncer(c, store, LangCN)
+	router := NewRouter()
+	s.Attach(router)
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Reconcile(context.Background()) }()
+	<-started
+
+	// o9 subscribes after and o1 unsubscribes before the snapshot
+	for _, e := range []struct{ event, from string }{{"subscribe", "o9"}, {"unsubscribe", "o1"}} {
+		m := &Message{MsgHeader: MsgHeader{Type: "event", FromUserName: e.from}, Event: e.event}
+		router.handler()(&Context{Context: context.Background(), Message: m})
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	s.Wait()
+
+	if _, ok, _ := store.Get("o9"); !ok {
+		t.Error("subscriber deleted by reconcile")
+	}
+	if _, ok, _ := store.Get("o1"); ok {
+		t.Error("unsubscriber put back by reconcile")
+	}
+}
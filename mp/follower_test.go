@@ -0,0 +1,117 @@
+// follower_test.go
+package mp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// followersMux serves n followers o0..o(n-1) by pages of size, like
+// /user/get, returning the last openid as next_openid of the last page.
+func followersMux(n, size int) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(followersUri, func(w http.ResponseWriter, r *http.Request) {
+		i := 0
+		if next := r.FormValue("next_openid"); next != "" {
+			fmt.Sscanf(next, "o%d", &i)
+			i++
+		}
+		var resp UserFollowersResponse
+		resp.Total = n
+		for ; i < n && resp.Count < size; i++ {
+			resp.Data.OpenIds = append(resp.Data.OpenIds, fmt.Sprintf("o%d", i))
+			resp.Count++
+		}
+		if resp.Count > 0 {
+			resp.NextOpenId = resp.Data.OpenIds[resp.Count-1]
+		}
+		json.NewEncoder(w).Encode(&resp)
+	})
+	mux.HandleFunc(userBatchGetUri, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Users []struct {
+				OpenId string `json:"openid"`
+			} `json:"user_list"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var resp struct {
+			Users []User `json:"user_info_list"`
+		}
+		for _, u := range req.Users {
+			resp.Users = append(resp.Users, User{OpenId: u.OpenId, Subscribe: 1, Nickname: "n-" + u.OpenId})
+		}
+		json.NewEncoder(w).Encode(&resp)
+	})
+	return mux
+}
+
+func TestFollowerIter(t *testing.T) {
+	c := newTestClient(t, followersMux(25, 10))
+	ctx := context.Background()
+
+	var ids []string
+	it := c.FollowerIter(ctx, "")
+	for it.Next() {
+		ids = append(ids, it.OpenId())
+		if len(ids) == 12 {
+			break
+		}
+	}
+	if it.Total() != 25 {
+		t.Errorf("total %d", it.Total())
+	}
+
+	it = c.FollowerIter(ctx, it.Checkpoint())
+	for it.Next() {
+		ids = append(ids, it.OpenId())
+	}
+	if it.Err() != nil || len(ids) != 25 || ids[12] != "o12" || ids[24] != "o24" {
+		t.Fatalf("%d followers, %v", len(ids), it.Err())
+	}
+
+	n := 0
+	idc, errc := c.StreamFollowers(ctx, "o19")
+	for range idc {
+		n++
+	}
+	if err := <-errc; err != nil || n != 5 {
+		t.Fatalf("streamed %d followers, %v", n, err)
+	}
+}
+
+func TestExportFollowers(t *testing.T) {
+	c := newTestClient(t, followersMux(150, 60))
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	last, err := c.ExportFollowers(ctx, &buf, ExportJSONLines, "", LangCN)
+	if err != nil || last != "o149" {
+		t.Fatalf("last %q, %v", last, err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var u User
+	if len(lines) != 150 || json.Unmarshal([]byte(lines[149]), &u) != nil || u.Nickname != "n-o149" {
+		t.Fatalf("%d lines, last %q", len(lines), lines[len(lines)-1])
+	}
+
+	buf.Reset()
+	if _, err := c.ExportFollowers(ctx, &buf, ExportCSV, "o139", LangCN); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 10 || !strings.HasPrefix(lines[0], "o140,1,n-o140,") {
+		t.Fatalf("csv %q", lines)
+	}
+
+	buf.Reset()
+	c.ExportFollowers(ctx, &buf, ExportCSV, "", LangCN)
+	if !strings.HasPrefix(buf.String(), "openid,subscribe,") {
+		t.Fatalf("csv header missing: %.40q", buf.String())
+	}
+}
@@ -1,30 +1,136 @@
 // menu
 package mp
 
-import ()
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	ButtonClick           = "click"
+	ButtonView            = "view"
+	ButtonScanCodePush    = "scancode_push"
+	ButtonScanCodeWaitMsg = "scancode_waitmsg"
+	ButtonPicSysPhoto     = "pic_sysphoto"
+	ButtonPicPhotoOrAlbum = "pic_photo_or_album"
+	ButtonPicWeixin       = "pic_weixin"
+	ButtonLocationSelect  = "location_select"
+	ButtonMediaId         = "media_id"
+	ButtonViewLimited     = "view_limited"
+	ButtonMiniprogram     = "miniprogram"
+)
+
+// limits of the custom menu, lengths are in bytes
+const (
+	maxButtons          = 3
+	maxSubButtons       = 5
+	maxButtonNameLen    = 16
+	maxSubButtonNameLen = 60
+	maxButtonKeyLen     = 128
+	maxButtonUrlLen     = 1024
+)
 
 type Button struct {
-	Type      string   `json:"type"`
+	Type      string   `json:"type,omitempty"`
 	Name      string   `json:"name"`
 	Key       string   `json:"key,omitempty"`
 	Url       string   `json:"url,omitempty"`
+	MediaId   string   `json:"media_id,omitempty"`
+	AppId     string   `json:"appid,omitempty"`
+	PagePath  string   `json:"pagepath,omitempty"`
 	SubButton []Button `json:"sub_button,omitempty"`
+
+	// Handler handles the event of the button, registered by MP.SetMenu
+	Handler HandlerFunc `json:"-"`
+}
+
+func ClickButton(name, key string) Button {
+	return Button{Type: ButtonClick, Name: name, Key: key}
+}
+
+func ViewButton(name, url string) Button {
+	return Button{Type: ButtonView, Name: name, Url: url}
+}
+
+func ScanCodePushButton(name, key string) Button {
+	return Button{Type: ButtonScanCodePush, Name: name, Key: key}
+}
+
+func ScanCodeWaitMsgButton(name, key string) Button {
+	return Button{Type: ButtonScanCodeWaitMsg, Name: name, Key: key}
+}
+
+func PicSysPhotoButton(name, key string) Button {
+	return Button{Type: ButtonPicSysPhoto, Name: name, Key: key}
+}
+
+func PicPhotoOrAlbumButton(name, key string) Button {
+	return Button{Type: ButtonPicPhotoOrAlbum, Name: name, Key: key}
+}
+
+func PicWeixinButton(name, key string) Button {
+	return Button{Type: ButtonPicWeixin, Name: name, Key: key}
+}
+
+func LocationSelectButton(name, key string) Button {
+	return Button{Type: ButtonLocationSelect, Name: name, Key: key}
+}
+
+// MediaIdButton sends the permanent material mediaId when clicked.
+func MediaIdButton(name, mediaId string) Button {
+	return Button{Type: ButtonMediaId, Name: name, MediaId: mediaId}
 }
 
-func (button *Button) AddSubButton(btn Button) {
-	if len(button.SubButton) == 5 {
-		return
+// ViewLimitedButton opens the news material mediaId when clicked.
+func ViewLimitedButton(name, mediaId string) Button {
+	return Button{Type: ButtonViewLimited, Name: name, MediaId: mediaId}
+}
+
+// MiniprogramButton opens pagePath of the mini program appId, url is
+// opened by clients not supporting mini programs.
+func MiniprogramButton(name, url, appId, pagePath string) Button {
+	return Button{Type: ButtonMiniprogram, Name: name, Url: url,
+		AppId: appId, PagePath: pagePath}
+}
+
+// Handle sets the handler of the button event, e.g.
+//
+//	menu.AddButton(ClickButton("今日歌曲", "V1001_TODAY_MUSIC").Handle(music))
+func (button Button) Handle(handler HandlerFunc) Button {
+	button.Handler = handler
+	return button
+}
+
+// event returns the event sent when the button is used, if it has a key.
+func (button *Button) event() (EventType, bool) {
+	switch button.Type {
+	case ButtonClick:
+		return EventClick, true
+	case ButtonScanCodePush, ButtonScanCodeWaitMsg, ButtonPicSysPhoto,
+		ButtonPicPhotoOrAlbum, ButtonPicWeixin, ButtonLocationSelect:
+		return EventType(button.Type), true
+	}
+	return "", false
+}
+
+func (button *Button) AddSubButton(btn Button) error {
+	if len(button.SubButton) == maxSubButtons {
+		return menuError(SubMenuButtonNumInvalid,
+			"%s: more than %d sub buttons", button.Name, maxSubButtons)
 	}
 	button.SubButton = append(button.SubButton, btn)
+	return nil
 }
 
 type ButtonList struct {
 	Buttons []Button `json:"button"`
 }
 
+// Menu is the custom menu, it marshals to the body of /menu/create
+// and unmarshals from the menu returned by /menu/get.
 type Menu struct {
-	buttons ButtonList `json:"menu"`
-	Error
+	ButtonList
 }
 
 func NewMenu() *Menu {
@@ -32,37 +138,241 @@ func NewMenu() *Menu {
 }
 
 func (menu *Menu) Size() int {
-	return len(menu.buttons.Buttons)
+	return len(menu.Buttons)
 }
 
-func (menu *Menu) AddClickButton(name, key string) {
-	if menu.Size() == 3 {
-		return
+// AddButton adds a top level button, use a Button with only a Name
+// to hold sub buttons.
+func (menu *Menu) AddButton(btn Button) error {
+	if menu.Size() == maxButtons {
+		return menuError(ButtonNumInvalid, "more than %d buttons", maxButtons)
 	}
-	btn := Button{Type: "click", Name: name, Key: key}
-	menu.buttons.Buttons = append(menu.buttons.Buttons, btn)
+	menu.Buttons = append(menu.Buttons, btn)
+	return nil
 }
 
-func (menu *Menu) AddViewButton(name, url string) {
-	if menu.Size() == 3 {
-		return
+// AddSubButton adds btn under the top level button index.
+func (menu *Menu) AddSubButton(index int, btn Button) error {
+	if index < 0 || index >= menu.Size() {
+		return menuError(ButtonNumInvalid, "button[%d] not exist", index)
 	}
-	btn := Button{Type: "view", Name: name, Url: url}
-	menu.buttons.Buttons = append(menu.buttons.Buttons, btn)
+	return menu.Buttons[index].AddSubButton(btn)
 }
 
-func (menu *Menu) AddClickSubButton(index int, name, key string) {
-	if index < 0 || index >= menu.Size() {
-		return
+func (menu *Menu) AddClickButton(name, key string) error {
+	return menu.AddButton(ClickButton(name, key))
+}
+
+func (menu *Menu) AddViewButton(name, url string) error {
+	return menu.AddButton(ViewButton(name, url))
+}
+
+func (menu *Menu) AddClickSubButton(index int, name, key string) error {
+	return menu.AddSubButton(index, ClickButton(name, key))
+}
+
+func (menu *Menu) AddViewSubButton(index int, name, url string) error {
+	return menu.AddSubButton(index, ViewButton(name, url))
+}
+
+// Validate checks the menu against the limits of weixin, the error is
+// an *APIError with the code the server would respond with, e.g.
+// errors.Is(err, ErrButtonNameLenInvalid).
+func (menu *Menu) Validate() error {
+	if menu == nil {
+		return menuError(ButtonNumInvalid, "nil menu")
 	}
-	btn := Button{Type: "click", Name: name, Key: key}
-	menu.buttons.Buttons[index].AddSubButton(btn)
+
+	buttons := menu.Buttons
+	if len(buttons) == 0 || len(buttons) > maxButtons {
+		return menuError(ButtonNumInvalid,
+			"%d buttons, want 1 to %d", len(buttons), maxButtons)
+	}
+
+	for i, btn := range buttons {
+		path := fmt.Sprintf("button[%d]", i)
+		if len(btn.SubButton) == 0 {
+			if err := validateButton(path, btn, false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(btn.Name) == 0 || len(btn.Name) > maxButtonNameLen {
+			return menuError(ButtonNameLenInvalid,
+				"%s: name must be 1 to %d bytes", path, maxButtonNameLen)
+		}
+		if len(btn.SubButton) > maxSubButtons {
+			return menuError(SubMenuButtonNumInvalid,
+				"%s: %d sub buttons, want at most %d", path, len(btn.SubButton), maxSubButtons)
+		}
+		for j, sub := range btn.SubButton {
+			subPath := fmt.Sprintf("%s.sub_button[%d]", path, j)
+			if len(sub.SubButton) > 0 {
+				return menuError(SubMenuDegreeInvalid,
+					"%s: sub buttons can not be nested", subPath)
+			}
+			if err := validateButton(subPath, sub, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
-func (menu *Menu) AddViewSubButton(index int, name, url string) {
-	if index < 0 || index >= menu.Size() {
-		return
+// clone returns a deep copy of menu.
+func (menu *Menu) clone() *Menu {
+	if menu == nil {
+		return nil
+	}
+	m := &Menu{}
+	for _, btn := range menu.Buttons {
+		btn.SubButton = append([]Button(nil), btn.SubButton...)
+		m.Buttons = append(m.Buttons, btn)
+	}
+	return m
+}
+
+// walk calls f for every button having no sub buttons.
+func (menu *Menu) walk(f func(btn *Button)) {
+	for i := range menu.Buttons {
+		btn := &menu.Buttons[i]
+		if len(btn.SubButton) == 0 {
+			f(btn)
+		}
+		for j := range btn.SubButton {
+			f(&btn.SubButton[j])
+		}
+	}
+}
+
+func validateButton(path string, btn Button, sub bool) error {
+	nameLen, nameCode := maxButtonNameLen, ButtonNameLenInvalid
+	typeCode, keyCode, urlCode := ButtonTypeInvalid, ButtonKeyLenInvalid, ButtonUrlLenInvalid
+	if sub {
+		nameLen, nameCode = maxSubButtonNameLen, SubMenuButtonNameLenInvalid
+		typeCode, keyCode, urlCode = SubMenuButtonTypeInvalid,
+			SubMenuButtonKeyLenInvalid, SubMenuButtonUrlLenInvalid
+	}
+
+	if len(btn.Name) == 0 || len(btn.Name) > nameLen {
+		return menuError(nameCode, "%s: name must be 1 to %d bytes", path, nameLen)
+	}
+
+	switch btn.Type {
+	case ButtonClick, ButtonScanCodePush, ButtonScanCodeWaitMsg,
+		ButtonPicSysPhoto, ButtonPicPhotoOrAlbum, ButtonPicWeixin,
+		ButtonLocationSelect:
+		if len(btn.Key) == 0 || len(btn.Key) > maxButtonKeyLen {
+			return menuError(keyCode, "%s: key must be 1 to %d bytes", path, maxButtonKeyLen)
+		}
+	case ButtonView:
+		if len(btn.Url) == 0 || len(btn.Url) > maxButtonUrlLen {
+			return menuError(urlCode, "%s: url must be 1 to %d bytes", path, maxButtonUrlLen)
+		}
+	case ButtonMediaId, ButtonViewLimited:
+		if len(btn.MediaId) == 0 {
+			return menuError(MediaIdMissing, "%s: media_id missing", path)
+		}
+	case ButtonMiniprogram:
+		if len(btn.Url) == 0 || len(btn.Url) > maxButtonUrlLen {
+			return menuError(urlCode, "%s: url must be 1 to %d bytes", path, maxButtonUrlLen)
+		}
+		if len(btn.AppId) == 0 || len(btn.PagePath) == 0 {
+			return menuError(ParamInvalid, "%s: appid and pagepath required", path)
+		}
+	default:
+		return menuError(typeCode, "%s: invalid type %q", path, btn.Type)
+	}
+
+	return nil
+}
+
+func menuError(code int, format string, a ...interface{}) error {
+	return &APIError{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+// MatchRule selects the users a conditional menu is shown to, empty
+// fields match everyone. Sex is "1" for male and "2" for female,
+// ClientPlatformType "1" for iOS, "2" for Android and "3" for others.
+type MatchRule struct {
+	TagId              string `json:"tag_id,omitempty"`
+	Sex                string `json:"sex,omitempty"`
+	Country            string `json:"country,omitempty"`
+	Province           string `json:"province,omitempty"`
+	City               string `json:"city,omitempty"`
+	ClientPlatformType string `json:"client_platform_type,omitempty"`
+	Language           string `json:"language,omitempty"`
+}
+
+// UnmarshalJSON accepts numbers as well, /menu/get returns
+// e.g. "sex":1 for a rule created with "sex":"1".
+func (rule *MatchRule) UnmarshalJSON(data []byte) error {
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&m); err != nil {
+		return err
 	}
-	btn := Button{Type: "view", Name: name, Url: url}
-	menu.buttons.Buttons[index].AddSubButton(btn)
+
+	fields := map[string]*string{
+		"tag_id":               &rule.TagId,
+		"sex":                  &rule.Sex,
+		"country":              &rule.Country,
+		"province":             &rule.Province,
+		"city":                 &rule.City,
+		"client_platform_type": &rule.ClientPlatformType,
+		"language":             &rule.Language,
+	}
+	for k, v := range m {
+		if p, ok := fields[k]; ok && v != nil {
+			*p = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+type ConditionalMenu struct {
+	MenuId    string
+	Menu      *Menu
+	MatchRule MatchRule
+}
+
+// SelfMenuInfo is the menu currently in effect, either created by the API
+// or configured in the web console (/get_current_selfmenu_info).
+type SelfMenuInfo struct {
+	IsMenuOpen bool
+	Buttons    []SelfMenuButton
+}
+
+// SelfMenuButton is a button of SelfMenuInfo. Buttons configured in the
+// web console have Type text, img, voice, video or news, with Value
+// holding the content, media_id or url, and news in NewsInfo.
+type SelfMenuButton struct {
+	Type      string             `json:"type,omitempty"`
+	Name      string             `json:"name"`
+	Key       string             `json:"key,omitempty"`
+	Url       string             `json:"url,omitempty"`
+	Value     string             `json:"value,omitempty"`
+	NewsInfo  SelfMenuNewsList   `json:"news_info"`
+	SubButton SelfMenuButtonList `json:"sub_button"`
+}
+
+type SelfMenuButtonList struct {
+	List []SelfMenuButton `json:"list"`
+}
+
+type SelfMenuNewsList struct {
+	List []SelfMenuNews `json:"list"`
+}
+
+type SelfMenuNews struct {
+	Title      string `json:"title"`
+	Author     string `json:"author"`
+	Digest     string `json:"digest"`
+	ShowCover  int    `json:"show_cover"`
+	CoverUrl   string `json:"cover_url"`
+	ContentUrl string `json:"content_url"`
+	SourceUrl  string `json:"source_url"`
 }
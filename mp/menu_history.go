@@ -0,0 +1,296 @@
+// menu history
+package mp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	MenuAdd    = "+"
+	MenuRemove = "-"
+	MenuUpdate = "~"
+)
+
+// MenuChange is a difference between two menus. Old is nil for
+// MenuAdd and New is nil for MenuRemove.
+type MenuChange struct {
+	Op   string
+	Path string // e.g. button[1].sub_button[0]
+	Old  *Button
+	New  *Button
+}
+
+func (c MenuChange) String() string {
+	switch c.Op {
+	case MenuAdd:
+		return fmt.Sprintf("+ %s %s", c.Path, buttonString(c.New))
+	case MenuRemove:
+		return fmt.Sprintf("- %s %s", c.Path, buttonString(c.Old))
+	}
+	return fmt.Sprintf("~ %s %s -> %s", c.Path, buttonString(c.Old), buttonString(c.New))
+}
+
+func buttonString(btn *Button) string {
+	s := fmt.Sprintf("%q", btn.Name)
+	if len(btn.Type) > 0 {
+		s = btn.Type + " " + s
+	}
+	switch {
+	case len(btn.Key) > 0:
+		s += " " + btn.Key
+	case len(btn.Url) > 0:
+		s += " " + btn.Url
+	case len(btn.MediaId) > 0:
+		s += " " + btn.MediaId
+	}
+	return s
+}
+
+// DiffMenu returns the changes turning menu old into menu new, buttons
+// are compared by position. Either menu may be nil.
+func DiffMenu(old, new *Menu) []MenuChange {
+	var a, b []Button
+	if old != nil {
+		a = old.Buttons
+	}
+	if new != nil {
+		b = new.Buttons
+	}
+	return diffButtons("button", a, b, true)
+}
+
+func diffButtons(name string, a, b []Button, nested bool) (changes []MenuChange) {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		path := fmt.Sprintf("%s[%d]", name, i)
+		switch {
+		case i >= len(a):
+			changes = append(changes, MenuChange{Op: MenuAdd, Path: path, New: &b[i]})
+		case i >= len(b):
+			changes = append(changes, MenuChange{Op: MenuRemove, Path: path, Old: &a[i]})
+		default:
+			if !sameButton(&a[i], &b[i]) {
+				changes = append(changes, MenuChange{Op: MenuUpdate, Path: path, Old: &a[i], New: &b[i]})
+			}
+			if nested {
+				changes = append(changes,
+					diffButtons(path+".sub_button", a[i].SubButton, b[i].SubButton, false)...)
+			}
+		}
+	}
+	return
+}
+
+// sameButton compares a and b, ignoring their sub buttons and handlers.
+func sameButton(a, b *Button) bool {
+	return a.Type == b.Type && a.Name == b.Name && a.Key == b.Key &&
+		a.Url == b.Url && a.MediaId == b.MediaId &&
+		a.AppId == b.AppId && a.PagePath == b.PagePath
+}
+
+// DiffMenu returns the changes SetMenu(menu) would make to the server's menu.
+func (c *Client) DiffMenu(menu *Menu) ([]MenuChange, error) {
+	return c.DiffMenuContext(context.Background(), menu)
+}
+
+func (c *Client) DiffMenuContext(ctx context.Context, menu *Menu) ([]MenuChange, error) {
+	current, _, err := c.GetMenuContext(ctx)
+	if err != nil && !errors.Is(err, ErrMenuDataExist) {
+		return nil, err
+	}
+	return DiffMenu(current, menu), nil
+}
+
+type MenuVersion struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Menu    *Menu     `json:"menu"`
+}
+
+// MenuHistory keeps the menus deployed, in order.
+type MenuHistory interface {
+	// Versions returns all versions, the oldest first.
+	Versions() ([]MenuVersion, error)
+	// Save adds menu as the latest version.
+	Save(menu *Menu) (MenuVersion, error)
+}
+
+// MemoryMenuHistory keeps copies of the menus, so that they are not
+// changed by the caller afterwards.
+type MemoryMenuHistory struct {
+	mu       sync.Mutex
+	versions []MenuVersion
+}
+
+func NewMemoryMenuHistory() *MemoryMenuHistory {
+	return &MemoryMenuHistory{}
+}
+
+func (h *MemoryMenuHistory) Versions() ([]MenuVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions := make([]MenuVersion, len(h.versions))
+	for i, v := range h.versions {
+		v.Menu = v.Menu.clone()
+		versions[i] = v
+	}
+	return versions, nil
+}
+
+func (h *MemoryMenuHistory) Save(menu *Menu) (MenuVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := MenuVersion{Version: len(h.versions) + 1, Time: time.Now(), Menu: menu.clone()}
+	h.versions = append(h.versions, v)
+	v.Menu = menu
+	return v, nil
+}
+
+// FileMenuHistory keeps the versions in a JSON file, rewritten on every Save.
+type FileMenuHistory struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileMenuHistory(path string) *FileMenuHistory {
+	return &FileMenuHistory{path: path}
+}
+
+// defaultMenuHistory returns the FileMenuHistory of appId in
+// <config dir>/weixin/menu_<appId>.json, see os.UserConfigDir.
+func defaultMenuHistory(appId string, logger Logger) MenuHistory {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		logger.Println("menu history kept in memory:", err)
+		return NewMemoryMenuHistory()
+	}
+	return NewFileMenuHistory(filepath.Join(dir, "weixin", "menu_"+appId+".json"))
+}
+
+func (h *FileMenuHistory) Versions() ([]MenuVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.load()
+}
+
+func (h *FileMenuHistory) load() (versions []MenuVersion, err error) {
+	data, err := ioutil.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &versions)
+	return
+}
+
+func (h *FileMenuHistory) Save(menu *Menu) (v MenuVersion, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions, err := h.load()
+	if err != nil {
+		return
+	}
+	v = MenuVersion{Version: len(versions) + 1, Time: time.Now(), Menu: menu}
+	if len(versions) > 0 {
+		v.Version = versions[len(versions)-1].Version + 1
+	}
+
+	data, err := json.MarshalIndent(append(versions, v), "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return
+	}
+	err = writeFileAtomic(h.path, data)
+	return
+}
+
+// MenuHistory returns the history used by Deploy and Rollback.
+func (c *Client) MenuHistory() MenuHistory {
+	return c.menuHistory
+}
+
+// Deploy sets menu and saves it as a new version. On the first deploy the
+// menu on the server, if any, is saved before, so that it can be rolled back to.
+func (c *Client) Deploy(menu *Menu) (MenuVersion, error) {
+	return c.deploy(context.Background(), menu, c.SetMenuContext)
+}
+
+func (c *Client) DeployContext(ctx context.Context, menu *Menu) (MenuVersion, error) {
+	return c.deploy(ctx, menu, c.SetMenuContext)
+}
+
+// Rollback sets the menu of version and saves it as a new version,
+// version 0 is the one before the latest. The history does not keep
+// button handlers, see MP.Rollback to restore them.
+func (c *Client) Rollback(version int) (MenuVersion, error) {
+	return c.rollback(context.Background(), version, c.SetMenuContext)
+}
+
+func (c *Client) RollbackContext(ctx context.Context, version int) (MenuVersion, error) {
+	return c.rollback(ctx, version, c.SetMenuContext)
+}
+
+type setMenuFunc func(ctx context.Context, menu *Menu) error
+
+func (c *Client) deploy(ctx context.Context, menu *Menu, set setMenuFunc) (v MenuVersion, err error) {
+	if err = menu.Validate(); err != nil {
+		return
+	}
+
+	versions, err := c.menuHistory.Versions()
+	if err != nil {
+		return
+	}
+	if len(versions) == 0 {
+		current, _, err := c.GetMenuContext(ctx)
+		if err == nil && current != nil {
+			_, err = c.menuHistory.Save(current)
+		}
+		if err != nil && !errors.Is(err, ErrMenuDataExist) {
+			return v, err
+		}
+	}
+
+	if err = set(ctx, menu); err != nil {
+		return
+	}
+	return c.menuHistory.Save(menu)
+}
+
+func (c *Client) rollback(ctx context.Context, version int, set setMenuFunc) (v MenuVersion, err error) {
+	versions, err := c.menuHistory.Versions()
+	if err != nil {
+		return
+	}
+
+	var menu *Menu
+	if version == 0 && len(versions) > 1 {
+		menu = versions[len(versions)-2].Menu
+	}
+	for i := range versions {
+		if version != 0 && versions[i].Version == version {
+			menu = versions[i].Menu
+		}
+	}
+	if menu == nil {
+		return v, fmt.Errorf("menu version %d not found", version)
+	}
+
+	if err = set(ctx, menu); err != nil {
+		return
+	}
+	return c.menuHistory.Save(menu)
+}
@@ -0,0 +1,164 @@
+// menu_history_test.go
+package mp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMenuDeploy(t *testing.T) {
+	live := `{"button":[{"type":"click","name":"今日歌曲","key":"V1001"}]}`
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"token","expires_in":7200}`)
+	})
+	mux.HandleFunc(menuQueryUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"menu":%s}`, live)
+	})
+	mux.HandleFunc(menuCreateUri, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		live = string(data)
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "menu.json")
+	c := NewClient("appid", "secret", WithBaseURL(srv.URL),
+		WithMenuHistory(NewFileMenuHistory(path)))
+
+	menu := NewMenu()
+	menu.AddClickButton("今日歌曲", "V1002")
+	menu.AddViewButton("搜索", "http://www.soso.com/")
+
+	changes, err := c.DiffMenu(menu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Op != MenuUpdate || changes[1].Op != MenuAdd ||
+		changes[1].Path != "button[1]" {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+
+	v, err := c.Deploy(menu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != 2 {
+		t.Fatalf("deployed version %d, want 2", v.Version)
+	}
+
+	if v, err = c.Rollback(0); err != nil || v.Version != 3 {
+		t.Fatalf("rollback: version %d, %v", v.Version, err)
+	}
+	current, _, err := c.GetMenu()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Size() != 1 || current.Buttons[0].Key != "V1001" {
+		t.Fatalf("menu not rolled back: %+v", current)
+	}
+
+	versions, err := NewFileMenuHistory(path).Versions()
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("%d versions, %v", len(versions), err)
+	}
+	if _, err := c.Rollback(10); err == nil {
+		t.Fatal("rollback to missing version succeeded")
+	}
+}
+
+func TestMenuRollbackHandlers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(menuQueryUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"errcode":46003,"errmsg":"menu no exist"}`)
+	})
+	mux.HandleFunc(menuCreateUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	path := filepath.Join(t.TempDir(), "menu.json")
+	mp := New("appid", "secret", "token")
+	mp.Client = newTestClient(t, mux)
+	mp.Client.menuHistory = NewFileMenuHistory(path)
+
+	if _, err := mp.Deploy(nil); err == nil {
+		t.Fatal("nil menu deployed")
+	}
+
+	var got string
+	a := NewMenu()
+	a.AddButton(ClickButton("a", "A").Handle(func(reply Replyer, m *Message) { got = "a" }))
+	b := NewMenu()
+	b.AddButton(ClickButton("b", "B").Handle(func(reply Replyer, m *Message) { got = "b" }))
+	if _, err := mp.Deploy(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mp.Deploy(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mp.Rollback(0); err != nil {
+		t.Fatal(err)
+	}
+	if h := mp.Client.lastMenu().Buttons[0].Handler; h == nil {
+		t.Fatal("handler not restored")
+	}
+	unhandled, orphaned := mp.CheckMenu(nil)
+	if len(unhandled) != 0 || len(orphaned) != 1 || orphaned[0] != "CLICK.B" {
+		t.Errorf("unhandled %q, orphaned %q", unhandled, orphaned)
+	}
+
+	m := Message{MsgHeader: MsgHeader{Type: "event"}, Event: "CLICK", EventKey: "A"}
+	mp.Dispatch(&Context{Message: &m})
+	if got != "a" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMemoryMenuHistoryCopies(t *testing.T) {
+	h := NewMemoryMenuHistory()
+	menu := NewMenu()
+	menu.AddClickButton("今日歌曲", "V1001")
+	if _, err := h.Save(menu); err != nil {
+		t.Fatal(err)
+	}
+
+	menu.Buttons[0].Name = "changed"
+	versions, _ := h.Versions()
+	if name := versions[0].Menu.Buttons[0].Name; name != "今日歌曲" {
+		t.Fatalf("saved menu changed to %q", name)
+	}
+	versions[0].Menu.Buttons[0].Name = "changed"
+	versions, _ = h.Versions()
+	if name := versions[0].Menu.Buttons[0].Name; name != "今日歌曲" {
+		t.Fatalf("saved menu changed to %q", name)
+	}
+}
+
+func TestDefaultMenuHistory(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	config, err := os.UserConfigDir()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	h, ok := NewClient("wxappid", "secret").MenuHistory().(*FileMenuHistory)
+	if !ok {
+		t.Fatal("default history is not a FileMenuHistory")
+	}
+	menu := NewMenu()
+	menu.AddClickButton("今日歌曲", "V1001")
+	if _, err := h.Save(menu); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(config, "weixin", "menu_wxappid.json")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,211 @@
+// menu_test.go
+package mp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMenuValidate(t *testing.T) {
+	var menu *Menu
+	if err := menu.Validate(); !errors.Is(err, ErrButtonNumInvalid) {
+		t.Fatalf("nil menu: %v", err)
+	}
+	c := NewClient("appid", "secret")
+	if err := c.SetMenu(nil); !errors.Is(err, ErrButtonNumInvalid) {
+		t.Fatalf("SetMenu(nil): %v", err)
+	}
+	if _, err := c.AddConditionalMenu(nil, MatchRule{}); !errors.Is(err, ErrButtonNumInvalid) {
+		t.Fatalf("AddConditionalMenu(nil): %v", err)
+	}
+
+	menu = NewMenu()
+	if err := menu.Validate(); !errors.Is(err, ErrButtonNumInvalid) {
+		t.Fatalf("empty menu: %v", err)
+	}
+
+	menu.AddClickButton("今日歌曲", "V1001_TODAY_MUSIC")
+	menu.AddButton(Button{Name: "菜单"})
+	menu.AddSubButton(1, ScanCodePushButton("扫码", "rselfmenu_0_1"))
+	menu.AddSubButton(1, MiniprogramButton("小程序", "http://mp.weixin.qq.com",
+		"wx286b93c14bbf93aa", "pages/lunar/index"))
+	menu.AddSubButton(1, MediaIdButton("图片", "MEDIA_ID1"))
+	if err := menu.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	menu.AddSubButton(1, PicWeixinButton("相册", ""))
+	if err := menu.Validate(); !errors.Is(err, ErrSubMenuButtonKeyLenInvalid) ||
+		!strings.Contains(err.Error(), "button[1].sub_button[3]") {
+		t.Fatalf("missing key: %v", err)
+	}
+
+	menu = NewMenu()
+	menu.AddClickButton(strings.Repeat("长", 6), "key") // 18 bytes
+	if err := menu.Validate(); !errors.Is(err, ErrButtonNameLenInvalid) {
+		t.Fatalf("long name: %v", err)
+	}
+
+	menu.AddClickButton("b", "k")
+	menu.AddClickButton("c", "k")
+	if err := menu.AddClickButton("d", "k"); !errors.Is(err, ErrButtonNumInvalid) {
+		t.Fatalf("4th button: %v", err)
+	}
+}
+
+func TestGetMenu(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(menuQueryUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"menu":{"button":[{"type":"click","name":"今日歌曲","key":"V1001"}],"menuid":208396938},
+			"conditionalmenu":[{"button":[{"type":"view","name":"搜索","url":"http://www.soso.com/"}],
+			"matchrule":{"tag_id":"2","sex":"1","client_platform_type":2},"menuid":208396993}]}`)
+	})
+	c := newTestClient(t, mux)
+
+	menu, conditional, err := c.GetMenu()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if menu.Size() != 1 || len(conditional) != 1 {
+		t.Fatalf("got %d buttons, %d conditional menus", menu.Size(), len(conditional))
+	}
+	cm := conditional[0]
+	if cm.MenuId != "208396993" || cm.MatchRule.ClientPlatformType != "2" ||
+		cm.MatchRule.TagId != "2" || cm.Menu.Size() != 1 {
+		t.Fatalf("unexpected conditional menu %+v", cm)
+	}
+}
+
+func TestMenuRoundTrip(t *testing.T) {
+	menu := NewMenu()
+	menu.AddClickButton("今日歌曲", "V1001_TODAY_MUSIC")
+	menu.AddButton(Button{Name: "菜单"})
+	menu.AddViewSubButton(1, "搜索", "http://www.soso.com/")
+
+	data, err := json.Marshal(menu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), `{"button":[`) {
+		t.Fatalf("unexpected json %s", data)
+	}
+
+	var m Menu
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Size() != 2 || m.Buttons[1].SubButton[0].Url != "http://www.soso.com/" {
+		t.Fatalf("unexpected menu %+v", m)
+	}
+}
+
+func TestGetSelfMenuInfo(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(selfMenuInfoUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"is_menu_open":1,"selfmenu_info":{"button":[
+			{"type":"text","name":"文本","value":"This is text!"},
+			{"name":"菜单","sub_button":{"list":[
+				{"type":"view","name":"搜索","url":"http://www.soso.com/"},
+				{"type":"news","name":"图文","value":"KQb_w_Tiz","news_info":{"list":[
+					{"title":"MULTI_NEWS","author":"JIMZHENG","digest":"text","show_cover":0,
+					"cover_url":"http://mmbiz.qpic.cn/cover","content_url":"http://mp.weixin.qq.com/s","source_url":""}]}}]}}]}}`)
+	})
+	c := newTestClient(t, mux)
+
+	info, err := c.GetSelfMenuInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsMenuOpen || len(info.Buttons) != 2 || info.Buttons[0].Value != "This is text!" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	subs := info.Buttons[1].SubButton.List
+	if len(subs) != 2 || len(subs[1].NewsInfo.List) != 1 ||
+		subs[1].NewsInfo.List[0].Author != "JIMZHENG" {
+		t.Fatalf("unexpected sub buttons %+v", subs)
+	}
+}
+
+func TestMenuHandlers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(menuCreateUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	mp := New("appid", "secret", "token")
+	mp.Client = newTestClient(t, mux)
+
+	var got string
+	handler := func(name string) HandlerFunc {
+		return func(reply Replyer, m *Message) { got = name }
+	}
+
+	menu := NewMenu()
+	menu.AddButton(ClickButton("今日歌曲", "V1001").Handle(handler("music")))
+	menu.AddButton(Button{Name: "菜单"})
+	menu.AddSubButton(1, ScanCodePushButton("扫码", "rselfmenu_0_1").Handle(handler("scan")))
+	menu.AddSubButton(1, LocationSelectButton("位置", "rselfmenu_2_0"))
+	mp.KeyFunc("V1002", handler("orphan"))
+	if err := mp.SetMenu(menu); err != nil {
+		t.Fatal(err)
+	}
+
+	m := Message{MsgHeader: MsgHeader{Type: "event"}, Event: "scancode_push", EventKey: "rselfmenu_0_1"}
+	mp.Dispatch(&Context{Message: &m})
+	if got != "scan" {
+		t.Fatalf("scancode_push: got %q", got)
+	}
+
+	unhandled, orphaned := mp.CheckMenu(nil)
+	if len(unhandled) != 1 || unhandled[0] != "location_select.rselfmenu_2_0" {
+		t.Errorf("unhandled %q", unhandled)
+	}
+	if len(orphaned) != 1 || orphaned[0] != "CLICK.V1002" {
+		t.Errorf("orphaned %q", orphaned)
+	}
+}
+
+func TestSetMenuWhileServing(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(menuCreateUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	mp := New("appid", "secret", "token")
+	mp.Client = newTestClient(t, mux)
+	mp.SetDedup(nil, DedupReplay)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		body := "<xml><FromUserName>user</FromUserName><MsgType>event</MsgType>" +
+			"<Event>CLICK</Event><EventKey>V1001</EventKey></xml>"
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mp.ServeHTTP(httptest.NewRecorder(), callbackRequest("token", body))
+			mp.CheckMenu(nil)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		menu := NewMenu()
+		menu.AddButton(ClickButton("今日歌曲", fmt.Sprintf("V%d", 1000+i)).
+			Handle(func(reply Replyer, m *Message) {}))
+		if err := mp.SetMenu(menu); err != nil {
+			t.Fatal(err)
+		}
+		mp.MatchFunc(Keyword("hi"), i, func(reply Replyer, m *Message) {})
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -2,8 +2,12 @@
 package mp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -15,6 +19,8 @@ const (
 	MsgImage                    = "image"
 	MsgVoice                    = "voice"
 	MsgVideo                    = "video"
+	MsgShortVideo               = "shortvideo"
+	MsgFile                     = "file"
 	MsgMusic                    = "music"
 	MsgNews                     = "news"
 	MsgLocation                 = "location"
@@ -31,13 +37,49 @@ const (
 	EventScan                  = "SCAN"
 	EventLocation              = "LOCATION"
 	EventClick                 = "CLICK"
+
+	// menu events, EventKey is the key of the button
+	EventScanCodePush    = "scancode_push"
+	EventScanCodeWaitMsg = "scancode_waitmsg"
+	EventPicSysPhoto     = "pic_sysphoto"
+	EventPicPhotoOrAlbum = "pic_photo_or_album"
+	EventPicWeixin       = "pic_weixin"
+	EventLocationSelect  = "location_select"
+
+	EventView                  = "VIEW"             // EventKey is the url
+	EventViewMiniprogram       = "view_miniprogram" // EventKey is the pagepath
+	EventMassSendJobFinish     = "MASSSENDJOBFINISH"
+	EventTemplateSendJobFinish = "TEMPLATESENDJOBFINISH"
+
+	// verify events
+	EventQualificationVerifySuccess = "qualification_verify_success"
+	EventQualificationVerifyFail    = "qualification_verify_fail"
+	EventNamingVerifySuccess        = "naming_verify_success"
+	EventNamingVerifyFail           = "naming_verify_fail"
+	EventAnnualRenew                = "annual_renew"
+	EventVerifyExpired              = "verify_expired"
+
+	// card events
+	EventCardPassCheck            = "card_pass_check"
+	EventCardNotPassCheck         = "card_not_pass_check"
+	EventUserGetCard              = "user_get_card"
+	EventUserGiftingCard          = "user_gifting_card"
+	EventUserDelCard              = "user_del_card"
+	EventUserConsumeCard          = "user_consume_card"
+	EventUserPayFromPayCell       = "user_pay_from_pay_cell"
+	EventUserViewCard             = "user_view_card"
+	EventUserEnterSessionFromCard = "user_enter_session_from_card"
+	EventUpdateMemberCard         = "update_member_card"
+	EventCardSkuRemind            = "card_sku_remind"
+	EventCardPayOrder             = "card_pay_order"
+	EventSubmitMemberCardUserInfo = "submit_membercard_user_info"
 )
 
 type MsgHeader struct {
 	ToUserName   string
 	FromUserName string
 	CreateTime   int64
-	Type         string
+	Type         string `xml:"MsgType"`
 }
 
 type ServiceMsgHeader struct {
@@ -62,6 +104,45 @@ type Article struct {
 	Url    string `json:"url"`
 }
 
+// ScanCodeInfo is sent with scancode_push and scancode_waitmsg.
+type ScanCodeInfo struct {
+	ScanType   string // e.g. qrcode, barcode
+	ScanResult string
+}
+
+// SendPicsInfo is sent with the pic_* events.
+type SendPicsInfo struct {
+	Count   int
+	PicList []struct {
+		PicMd5Sum string
+	} `xml:"PicList>item"`
+}
+
+// SendLocationInfo is sent with location_select.
+type SendLocationInfo struct {
+	LocationX float64 `xml:"Location_X"`
+	LocationY float64 `xml:"Location_Y"`
+	Scale     int
+	Label     string
+	Poiname   string
+}
+
+// CopyrightCheckResult is the originality check of a mass send job.
+type CopyrightCheckResult struct {
+	Count      int
+	CheckState int
+	ResultList []struct {
+		ArticleIdx            int
+		UserDeclareState      int
+		AuditState            int
+		OriginalArticleUrl    string
+		OriginalArticleType   int
+		CanReprint            int
+		NeedReplaceContent    int
+		NeedShowReprintSource int
+	} `xml:"ResultList>item"`
+}
+
 type Message struct {
 	MsgHeader
 	TitleDesc
@@ -74,6 +155,9 @@ type Message struct {
 	ArticleCount int
 	Articles     []Article
 	Format       string
+	FileKey      string
+	FileMd5      string
+	FileTotalLen int64
 	Recognition  string
 	LocationX    float64 `xml:"Location_X"`
 	LocationY    float64 `xml:"Location_Y"`
@@ -85,8 +169,61 @@ type Message struct {
 	Latitude     float64
 	Longitude    float64
 	Precision    float64
+	MenuId       string
+
+	// menu events
+	ScanCodeInfo     ScanCodeInfo
+	SendPicsInfo     SendPicsInfo
+	SendLocationInfo SendLocationInfo
+
+	// MASSSENDJOBFINISH and TEMPLATESENDJOBFINISH, MsgID is the id of the
+	// job, not to be confused with MsgId
+	MsgID                uint64 `xml:"MsgID"`
+	Status               string
+	TotalCount           int
+	FilterCount          int
+	SentCount            int
+	ErrorCount           int
+	CopyrightCheckResult CopyrightCheckResult
+
+	// verify events
+	ExpiredTime int64
+	FailTime    int64
+	FailReason  string
+
+	// card events
+	CardId              string
+	UserCardCode        string
+	OldUserCardCode     string
+	IsGiveByFriend      int
+	FriendUserName      string
+	IsReturnBack        int
+	IsChatRoom          int
+	IsRestoreMemberCard int
+	OuterId             int
+	OuterStr            string
+	UnionId             string
+	RefuseReason        string
+	ConsumeSource       string
+	LocationName        string
+	StaffOpenId         string
+	VerifyCode          string
+	RemarkAmount        string
+	TransId             string
+	LocationId          int64
+	Fee                 int
+	OriginalFee         int
+	ModifyBonus         int
+	ModifyBalance       int
+	Detail              string
+
+	// captured groups of the matching router rule
+	Matches []string `xml:"-"`
 }
 
+// Replyer answers a message. The first reply is the passive response to
+// the callback, the following ones are sent in order through the customer
+// service API once the handler returns.
 type Replyer interface {
 	ReplyText(content string) error
 	ReplyImage(mediaId string) error
@@ -96,20 +233,152 @@ type Replyer interface {
 	ReplyImageText(articles []Article) error
 }
 
+// ErrNoClient is returned by a Replyer which can not reply passively
+// anymore and has no Client to send the reply with.
+var ErrNoClient = errors.New("no client to send the reply")
+
+// sendFunc sends a reply through the customer service API.
+type sendFunc func(ctx context.Context, c *Client) error
+
 type messageReply struct {
+	mu           sync.Mutex
 	fromUserName string
 	toUserName   string
 	w            http.ResponseWriter
 	replied      bool
+	crypter      *MsgCrypter
+	nonce        string
+	data         []byte // the reply written, for deduplication
+
+	// replies after the first one are queued in pending and sent with
+	// client through the customer service API. async is set once the
+	// callback has been answered, the replies are then sent right away.
+	// smu keeps the sends in order without holding mu.
+	pending []sendFunc
+	async   bool
+	smu     sync.Mutex
+	client  *Client
+	onError func(err error)
+}
+
+// DecodeMessage parses the plaintext XML of a callback message.
+func DecodeMessage(data []byte) (*Message, error) {
+	msg := &Message{}
+	if err := xml.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// NewReplyer returns a Replyer writing the passive reply to m into w,
+// encrypted if crypter is not nil. nonce is the one of the request.
+func NewReplyer(w http.ResponseWriter, m *Message, crypter *MsgCrypter, nonce string) Replyer {
+	return newMessageReply(w, m, crypter, nonce)
+}
+
+func newMessageReply(w http.ResponseWriter, m *Message, crypter *MsgCrypter, nonce string) *messageReply {
+	return &messageReply{fromUserName: m.ToUserName,
+		toUserName: m.FromUserName, w: w,
+		crypter: crypter, nonce: nonce}
+}
+
+// timeout answers the callback with "success" if no reply has been
+// written yet, and switches the following replies to async.
+func (r *messageReply) timeout() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.async = true
+	if !r.replied {
+		r.replied = true
+		r.data = []byte("success")
+		r.w.Write(r.data)
+	}
+}
+
+// finish switches the replies made after ServeHTTP has returned to async.
+func (r *messageReply) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.async = true
 }
 
-func (r *messageReply) reply(v interface{}) error {
+func (r *messageReply) isReplied() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.replied
+}
+
+func (r *messageReply) written() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.data
+}
+
+func (r *messageReply) hasPending() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending) > 0
+}
+
+// flush sends the queued replies in order.
+func (r *messageReply) flush() {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+	r.sendPending()
+}
+
+// sendPending sends the queued replies, r.smu must be held.
+func (r *messageReply) sendPending() {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+
+	for _, send := range pending {
+		if err := r.send(send); err != nil && r.onError != nil {
+			r.onError(err)
+		}
+	}
+}
+
+func (r *messageReply) send(send sendFunc) error {
+	if r.client == nil {
+		return ErrNoClient
+	}
+	return send(context.Background(), r.client)
+}
+
+func (r *messageReply) reply(v interface{}, send sendFunc) error {
+	r.mu.Lock()
+	if r.async {
+		r.mu.Unlock()
+		// no reply is queued once async is set, the queue goes out first
+		r.smu.Lock()
+		defer r.smu.Unlock()
+		r.sendPending()
+		return r.send(send)
+	}
+	defer r.mu.Unlock()
+
+	if r.replied {
+		r.pending = append(r.pending, send)
+		return nil
+	}
+
 	r.replied = true
 
 	data, err := xml.Marshal(v)
 	if err != nil {
 		return err
 	}
+	if r.crypter != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		if data, err = EncryptMessage(r.crypter, timestamp, r.nonce, data); err != nil {
+			return err
+		}
+	}
+	r.data = data
 	r.w.Header().Set("Content-Type", xmlContentType)
 	_, err = r.w.Write(data)
 	return err
@@ -128,7 +397,9 @@ func (r *messageReply) ReplyText(content string) error {
 	data.CreateTime = time.Now().Unix()
 	data.Content = content
 
-	return r.reply(&data)
+	return r.reply(&data, func(ctx context.Context, c *Client) error {
+		return c.SendTextContext(ctx, r.toUserName, content)
+	})
 }
 
 func (r *messageReply) ReplyImage(mediaId string) error {
@@ -146,7 +417,9 @@ func (r *messageReply) ReplyImage(mediaId string) error {
 	data.CreateTime = time.Now().Unix()
 	data.Image.MediaId = mediaId
 
-	return r.reply(&data)
+	return r.reply(&data, func(ctx context.Context, c *Client) error {
+		return c.SendImageContext(ctx, r.toUserName, mediaId)
+	})
 }
 
 func (r *messageReply) ReplyVoice(mediaId string) error {
@@ -164,7 +437,9 @@ func (r *messageReply) ReplyVoice(mediaId string) error {
 	data.CreateTime = time.Now().Unix()
 	data.Voice.MediaId = mediaId
 
-	return r.reply(&data)
+	return r.reply(&data, func(ctx context.Context, c *Client) error {
+		return c.SendVoiceContext(ctx, r.toUserName, mediaId)
+	})
 }
 
 func (r *messageReply) ReplyVideo(mediaId string, info TitleDesc) error {
@@ -184,7 +459,9 @@ func (r *messageReply) ReplyVideo(mediaId string, info TitleDesc) error {
 	data.Video.MediaId = mediaId
 	data.Video.TitleDesc = info
 
-	return r.reply(&data)
+	return r.reply(&data, func(ctx context.Context, c *Client) error {
+		return c.SendVideoContext(ctx, r.toUserName, mediaId, info)
+	})
 }
 
 func (r *messageReply) ReplyMusic(info TitleDesc, music Music) error {
@@ -204,7 +481,9 @@ func (r *messageReply) ReplyMusic(info TitleDesc, music Music) error {
 	data.M.TitleDesc = info
 	data.M.Music = music
 
-	return r.reply(&data)
+	return r.reply(&data, func(ctx context.Context, c *Client) error {
+		return c.SendMusicContext(ctx, r.toUserName, info, music)
+	})
 }
 
 func (r *messageReply) ReplyImageText(articles []Article) error {
@@ -222,5 +501,7 @@ func (r *messageReply) ReplyImageText(articles []Article) error {
 	data.ArticleCount = len(articles)
 	data.Articles = articles
 
-	return r.reply(&data)
+	return r.reply(&data, func(ctx context.Context, c *Client) error {
+		return c.SendImageTextContext(ctx, r.toUserName, articles)
+	})
 }
@@ -0,0 +1,66 @@
+// message_test.go
+package mp
+
+import "testing"
+
+func TestDecodeEvents(t *testing.T) {
+	router := NewRouter()
+	var got *Message
+	for _, event := range []EventType{EventScanCodeWaitMsg, EventPicWeixin,
+		EventLocationSelect, EventMassSendJobFinish, EventUserGetCard} {
+		router.EventFunc(event, func(reply Replyer, m *Message) { got = m })
+	}
+
+	decode := func(xml string) *Message {
+		m, err := DecodeMessage([]byte(xml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		router.Dispatch(&Context{Message: m})
+		if got != m {
+			t.Fatalf("event %s not routed", m.Event)
+		}
+		return m
+	}
+
+	m := decode(`<xml><ToUserName>gh</ToUserName><FromUserName>oUser</FromUserName>
+		<CreateTime>1408090502</CreateTime><MsgType>event</MsgType>
+		<Event>scancode_waitmsg</Event><EventKey>6</EventKey>
+		<ScanCodeInfo><ScanType>qrcode</ScanType><ScanResult>2</ScanResult></ScanCodeInfo></xml>`)
+	if m.ScanCodeInfo.ScanType != "qrcode" || m.ScanCodeInfo.ScanResult != "2" {
+		t.Errorf("ScanCodeInfo %+v", m.ScanCodeInfo)
+	}
+
+	m = decode(`<xml><MsgType>event</MsgType><Event>pic_weixin</Event><EventKey>6</EventKey>
+		<SendPicsInfo><Count>1</Count><PicList><item><PicMd5Sum>5a75aaca</PicMd5Sum></item></PicList>
+		</SendPicsInfo></xml>`)
+	if m.SendPicsInfo.Count != 1 || len(m.SendPicsInfo.PicList) != 1 ||
+		m.SendPicsInfo.PicList[0].PicMd5Sum != "5a75aaca" {
+		t.Errorf("SendPicsInfo %+v", m.SendPicsInfo)
+	}
+
+	m = decode(`<xml><MsgType>event</MsgType><Event>location_select</Event><EventKey>6</EventKey>
+		<SendLocationInfo><Location_X>23</Location_X><Location_Y>113</Location_Y><Scale>15</Scale>
+		<Label>广州市海珠区</Label><Poiname></Poiname></SendLocationInfo></xml>`)
+	if m.SendLocationInfo.LocationY != 113 || m.SendLocationInfo.Label != "广州市海珠区" {
+		t.Errorf("SendLocationInfo %+v", m.SendLocationInfo)
+	}
+
+	m = decode(`<xml><MsgType>event</MsgType><Event>MASSSENDJOBFINISH</Event>
+		<MsgID>1988</MsgID><Status>sendsuccess</Status><TotalCount>100</TotalCount>
+		<FilterCount>80</FilterCount><SentCount>75</SentCount><ErrorCount>5</ErrorCount>
+		<CopyrightCheckResult><Count>1</Count><ResultList><item><ArticleIdx>1</ArticleIdx>
+		<AuditState>2</AuditState></item></ResultList><CheckState>2</CheckState></CopyrightCheckResult></xml>`)
+	if m.MsgID != 1988 || m.MsgId != 0 || m.SentCount != 75 ||
+		len(m.CopyrightCheckResult.ResultList) != 1 || m.CopyrightCheckResult.CheckState != 2 {
+		t.Errorf("mass send job %+v", m)
+	}
+
+	m = decode(`<xml><MsgType>event</MsgType><Event>user_get_card</Event>
+		<CardId>pFS7Fjg8kV1I</CardId><IsGiveByFriend>1</IsGiveByFriend>
+		<UserCardCode>12312312</UserCardCode><OuterStr>12b</OuterStr></xml>`)
+	if m.CardId != "pFS7Fjg8kV1I" || m.IsGiveByFriend != 1 || m.OuterStr != "12b" {
+		t.Errorf("card event %+v", m)
+	}
+}
@@ -0,0 +1,139 @@
+// middleware
+package mp
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour, such as
+// recovery, logging or rate limiting.
+type Middleware func(next ContextFunc) ContextFunc
+
+// chain applies middlewares to h, the first one being the outermost.
+func chain(middlewares []Middleware, h ContextFunc) ContextFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Use adds middlewares applied to every message before dispatching.
+func (router *Router) Use(middlewares ...Middleware) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	// copy on write, handler chains the middlewares without the lock
+	mws := make([]Middleware, 0, len(router.middlewares)+len(middlewares))
+	mws = append(mws, router.middlewares...)
+	router.middlewares = append(mws, middlewares...)
+}
+
+// handler returns Dispatch wrapped by the middlewares in use.
+func (router *Router) handler() ContextFunc {
+	router.mu.RLock()
+	middlewares := router.middlewares
+	router.mu.RUnlock()
+	return chain(middlewares, router.Dispatch)
+}
+
+// Group returns a route group, whose handlers are wrapped
+// with the given middlewares.
+func (router *Router) Group(middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{router: router, middlewares: middlewares}
+}
+
+type RouteGroup struct {
+	router      *Router
+	middlewares []Middleware
+}
+
+func (g *RouteGroup) Use(middlewares ...Middleware) {
+	g.middlewares = append(g.middlewares, middlewares...)
+}
+
+// Group returns a nested group inheriting the middlewares of g.
+func (g *RouteGroup) Group(middlewares ...Middleware) *RouteGroup {
+	mws := make([]Middleware, 0, len(g.middlewares)+len(middlewares))
+	mws = append(mws, g.middlewares...)
+	return &RouteGroup{router: g.router, middlewares: append(mws, middlewares...)}
+}
+
+func (g *RouteGroup) Handle(msgType MsgType, handler ContextFunc) {
+	g.router.Handle(msgType, chain(g.middlewares, handler))
+}
+
+func (g *RouteGroup) Event(event EventType, handler ContextFunc) {
+	g.router.Event(event, chain(g.middlewares, handler))
+}
+
+func (g *RouteGroup) Key(key string, handler ContextFunc) {
+	g.router.Key(key, chain(g.middlewares, handler))
+}
+
+func (g *RouteGroup) EventKey(event EventType, key string, handler ContextFunc) {
+	g.router.EventKey(event, key, chain(g.middlewares, handler))
+}
+
+func (g *RouteGroup) Match(matcher Matcher, priority int, handler ContextFunc) {
+	g.router.Match(matcher, priority, chain(g.middlewares, handler))
+}
+
+func (g *RouteGroup) HandleFunc(msgType MsgType, handler HandlerFunc) {
+	g.Handle(msgType, Adapt(handler))
+}
+
+func (g *RouteGroup) EventFunc(event EventType, handler HandlerFunc) {
+	g.Event(event, Adapt(handler))
+}
+
+func (g *RouteGroup) KeyFunc(key string, handler HandlerFunc) {
+	g.Key(key, Adapt(handler))
+}
+
+func (g *RouteGroup) EventKeyFunc(event EventType, key string, handler HandlerFunc) {
+	g.EventKey(event, key, Adapt(handler))
+}
+
+func (g *RouteGroup) MatchFunc(matcher Matcher, priority int, handler HandlerFunc) {
+	g.Match(matcher, priority, Adapt(handler))
+}
+
+// Recover logs the panics of handlers instead of crashing the server.
+func Recover(logger Logger) Middleware {
+	return func(next ContextFunc) ContextFunc {
+		return func(c *Context) {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Println("panic:", err, "\n"+string(debug.Stack()))
+				}
+			}()
+			next(c)
+		}
+	}
+}
+
+// AccessLog logs every message with the time spent handling it.
+func AccessLog(logger Logger) Middleware {
+	return func(next ContextFunc) ContextFunc {
+		return func(c *Context) {
+			start := time.Now()
+			next(c)
+			m := c.Message
+			logger.Println(m.FromUserName, m.Type, m.Event, m.EventKey,
+				time.Since(start))
+		}
+	}
+}
+
+// Timing reports the time spent handling every message to observe,
+// e.g. to feed a metrics histogram.
+func Timing(observe func(m *Message, elapsed time.Duration)) Middleware {
+	return func(next ContextFunc) ContextFunc {
+		return func(c *Context) {
+			start := time.Now()
+			next(c)
+			observe(c.Message, time.Since(start))
+		}
+	}
+}
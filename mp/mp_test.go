@@ -2,9 +2,201 @@
 package mp
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func testMP(t *testing.T) {
 
 }
+
+type fakeState struct {
+	tokens int32
+	sent   chan string // bodies posted to the custom send API
+}
+
+// fakeServer counts /token requests and rejects the first token with 40001.
+func fakeServer(t *testing.T) (*httptest.Server, *fakeState) {
+	state := &fakeState{sent: make(chan string, 16)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenUri, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&state.tokens, 1)
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":7200}`, n)
+	})
+	mux.HandleFunc(userInfoUri, func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("access_token") == "token1" {
+			fmt.Fprint(w, `{"errcode":40001,"errmsg":"invalid credential"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"subscribe":1,"openid":"%s"}`, r.FormValue("openid"))
+	})
+	mux.HandleFunc(customSendUri, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		state.sent <- string(body)
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	return httptest.NewServer(mux), state
+}
+
+func TestTokenRetry(t *testing.T) {
+	srv, state := fakeServer(t)
+	defer srv.Close()
+
+	mp := New("appid", "secret", "token",
+		WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := mp.UserInfoContext(context.Background(), "oid", LangCN)
+			if err != nil || user.OpenId != "oid" {
+				t.Errorf("got %+v, %v", user, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// one initial token, one refresh after 40001
+	if n := atomic.LoadInt32(&state.tokens); n != 2 {
+		t.Fatalf("%d token requests, want 2", n)
+	}
+}
+
+// callbackRequest builds a signed plaintext callback request.
+func callbackRequest(token, body string) *http.Request {
+	timestamp, nonce := "1409304348", "nonce"
+	q := url.Values{}
+	q.Set("signature", checkSignatureOf(token, timestamp, nonce))
+	q.Set("timestamp", timestamp)
+	q.Set("nonce", nonce)
+	return httptest.NewRequest("POST", "/?"+q.Encode(), strings.NewReader(body))
+}
+
+func TestReplyTimeout(t *testing.T) {
+	srv, state := fakeServer(t)
+	defer srv.Close()
+
+	mp := New("appid", "secret", "token",
+		WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+	mp.SetReplyTimeout(20 * time.Millisecond)
+
+	errc := make(chan error, 1)
+	mp.HandleFunc(MsgText, func(reply Replyer, m *Message) {
+		time.Sleep(50 * time.Millisecond)
+		errc <- reply.ReplyText("late answer")
+	})
+
+	body := "<xml><ToUserName>gh_1</ToUserName><FromUserName>user</FromUserName>" +
+		"<CreateTime>1</CreateTime><MsgType>text</MsgType><Content>order</Content>" +
+		"<MsgId>1</MsgId></xml>"
+	w := httptest.NewRecorder()
+	mp.ServeHTTP(w, callbackRequest("token", body))
+	if w.Body.String() != "success" {
+		t.Fatalf("got %q, want success", w.Body)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if sent := <-state.sent; !strings.Contains(sent, "late answer") ||
+		!strings.Contains(sent, `"touser":"user"`) {
+		t.Fatalf("unexpected custom message %s", sent)
+	}
+}
+
+func TestMultiReply(t *testing.T) {
+	srv, state := fakeServer(t)
+	defer srv.Close()
+
+	mp := New("appid", "secret", "token",
+		WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+	mp.HandleFunc(MsgText, func(reply Replyer, m *Message) {
+		reply.ReplyText("first")
+		reply.ReplyImage("media1")
+		reply.ReplyImageText([]Article{{Url: "http://example.com"}})
+	})
+
+	body := "<xml><ToUserName>gh_1</ToUserName><FromUserName>user</FromUserName>" +
+		"<CreateTime>1</CreateTime><MsgType>text</MsgType><Content>menu</Content>" +
+		"<MsgId>2</MsgId></xml>"
+	w := httptest.NewRecorder()
+	mp.ServeHTTP(w, callbackRequest("token", body))
+	if !strings.Contains(w.Body.String(), "first") {
+		t.Fatalf("passive reply %q", w.Body)
+	}
+
+	for _, want := range []string{`"msgtype":"image"`, `"msgtype":"news"`} {
+		select {
+		case sent := <-state.sent:
+			if !strings.Contains(sent, want) {
+				t.Fatalf("got %s, want %s", sent, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("custom message not sent")
+		}
+	}
+}
+
+func TestReplyAfterReturn(t *testing.T) {
+	srv, state := fakeServer(t)
+	defer srv.Close()
+
+	mp := New("appid", "secret", "token",
+		WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+	replied := make(chan error, 2)
+	mp.HandleFunc(MsgText, func(reply Replyer, m *Message) {
+		reply.ReplyText("first")
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			replied <- reply.ReplyImage("media1")
+			replied <- reply.ReplyVoice("media2")
+		}()
+	})
+
+	body := "<xml><ToUserName>gh_1</ToUserName><FromUserName>user</FromUserName>" +
+		"<CreateTime>1</CreateTime><MsgType>text</MsgType><Content>menu</Content>" +
+		"<MsgId>3</MsgId></xml>"
+	w := httptest.NewRecorder()
+	mp.ServeHTTP(w, callbackRequest("token", body))
+	if !strings.Contains(w.Body.String(), "first") {
+		t.Fatalf("passive reply %q", w.Body)
+	}
+
+	for _, want := range []string{`"msgtype":"image"`, `"msgtype":"voice"`} {
+		if err := <-replied; err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case sent := <-state.sent:
+			if !strings.Contains(sent, want) {
+				t.Fatalf("got %s, want %s", sent, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("custom message not sent")
+		}
+	}
+}
+
+// newTestClient returns a Client calling the API served by mux,
+// with the /token endpoint added.
+func newTestClient(t *testing.T, mux *http.ServeMux) *Client {
+	mux.HandleFunc(tokenUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"token","expires_in":7200}`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return NewClient("appid", "secret", WithBaseURL(srv.URL),
+		WithHTTPClient(srv.Client()), WithMenuHistory(NewMemoryMenuHistory()))
+}
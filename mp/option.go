@@ -0,0 +1,90 @@
+// option
+package mp
+
+import (
+	"log"
+	"net/http"
+	"os"
+)
+
+// Logger is satisfied by *log.Logger.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+type options struct {
+	client     *http.Client
+	baseUrl    string
+	logger     Logger
+	tokenStore TokenStore
+	history    MenuHistory
+	aesKey     string
+	cryptMode  CryptMode
+}
+
+type Option func(*options)
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		client:  http.DefaultClient,
+		baseUrl: baseUrl,
+		logger:  log.New(os.Stderr, "", log.LstdFlags),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.tokenStore == nil {
+		o.tokenStore = NewMemoryTokenStore()
+	}
+	return o
+}
+
+// WithHTTPClient sets the client used for API requests, e.g. to
+// configure timeouts, proxies or TLS. Default is http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		if client != nil {
+			o.client = client
+		}
+	}
+}
+
+// WithBaseURL replaces https://api.weixin.qq.com/cgi-bin, e.g. to point
+// the API to a local fake during tests.
+func WithBaseURL(url string) Option {
+	return func(o *options) {
+		o.baseUrl = url
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithMenuHistory sets the history of Deploy and Rollback. Default is a
+// FileMenuHistory in <config dir>/weixin/menu_<appId>.json, where the
+// config dir is the one of os.UserConfigDir, e.g. ~/.config on Linux.
+func WithMenuHistory(history MenuHistory) Option {
+	return func(o *options) {
+		o.history = history
+	}
+}
+
+// WithEncodingAESKey enables message encryption on the Server, see
+// Server.SetAESKey. New and NewServer panic if the key is invalid.
+func WithEncodingAESKey(encodingAESKey string, mode CryptMode) Option {
+	return func(o *options) {
+		o.aesKey = encodingAESKey
+		o.cryptMode = mode
+	}
+}
+
+func WithTokenStore(store TokenStore) Option {
+	return func(o *options) {
+		o.tokenStore = store
+	}
+}
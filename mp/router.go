@@ -0,0 +1,252 @@
+// router
+package mp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Matcher decides whether a rule applies to a message, groups are
+// the captured values made available in Message.Matches.
+type Matcher interface {
+	Match(m *Message) (groups []string, ok bool)
+}
+
+type MatcherFunc func(m *Message) ([]string, bool)
+
+func (f MatcherFunc) Match(m *Message) ([]string, bool) {
+	return f(m)
+}
+
+// Keyword matches text messages whose content equals one of words.
+func Keyword(words ...string) Matcher {
+	return MatcherFunc(func(m *Message) ([]string, bool) {
+		if m.Type != string(MsgText) {
+			return nil, false
+		}
+		content := strings.TrimSpace(m.Content)
+		for _, w := range words {
+			if content == w {
+				return []string{content}, true
+			}
+		}
+		return nil, false
+	})
+}
+
+// KeywordFold is like Keyword, but case-insensitive.
+func KeywordFold(words ...string) Matcher {
+	return MatcherFunc(func(m *Message) ([]string, bool) {
+		if m.Type != string(MsgText) {
+			return nil, false
+		}
+		content := strings.TrimSpace(m.Content)
+		for _, w := range words {
+			if strings.EqualFold(content, w) {
+				return []string{content}, true
+			}
+		}
+		return nil, false
+	})
+}
+
+// Prefix matches text messages starting with prefix, the groups are the
+// content and the remainder, e.g. "订单 12345" -> ["订单 12345", "12345"].
+func Prefix(prefix string) Matcher {
+	return MatcherFunc(func(m *Message) ([]string, bool) {
+		if m.Type != string(MsgText) {
+			return nil, false
+		}
+		content := strings.TrimSpace(m.Content)
+		if !strings.HasPrefix(content, prefix) {
+			return nil, false
+		}
+		rest := strings.TrimSpace(content[len(prefix):])
+		return []string{content, rest}, true
+	})
+}
+
+// Regexp matches the content of text messages against expr, the groups
+// are the submatches. It panics if expr can not be compiled.
+func Regexp(expr string) Matcher {
+	re := regexp.MustCompile(expr)
+	return MatcherFunc(func(m *Message) ([]string, bool) {
+		if m.Type != string(MsgText) {
+			return nil, false
+		}
+		groups := re.FindStringSubmatch(strings.TrimSpace(m.Content))
+		return groups, groups != nil
+	})
+}
+
+// Predicate matches any message for which f returns true.
+func Predicate(f func(m *Message) bool) Matcher {
+	return MatcherFunc(func(m *Message) ([]string, bool) {
+		return nil, f(m)
+	})
+}
+
+// keyEvents are the events routed by EventKey.
+var keyEvents = []EventType{EventClick, EventScanCodePush, EventScanCodeWaitMsg,
+	EventPicSysPhoto, EventPicPhotoOrAlbum, EventPicWeixin, EventLocationSelect}
+
+type rule struct {
+	matcher  Matcher
+	priority int
+	handler  ContextFunc
+}
+
+// Router dispatches messages to the first matching rule by priority,
+// then to the handler registered for the message type, event or key,
+// and finally to the NotFound handler. Handlers may be registered while
+// messages are being dispatched.
+type Router struct {
+	mu          sync.RWMutex
+	routes      map[string]ContextFunc
+	rules       []rule
+	notFound    ContextFunc
+	middlewares []Middleware
+}
+
+func NewRouter() *Router {
+	router := &Router{routes: make(map[string]ContextFunc)}
+
+	// default event handler, you can overwrite it by setting
+	// your own event handler
+	router.Handle(MsgEvent, func(c *Context) {
+		router.route(c.Message.Type+"."+c.Message.Event, c)
+	})
+	// default handlers of the events carrying the key of a menu button
+	for _, event := range keyEvents {
+		router.Event(event, func(c *Context) {
+			m := c.Message
+			router.route(m.Type+"."+m.Event+"."+m.EventKey, c)
+		})
+	}
+
+	return router
+}
+
+func (router *Router) Handle(msgType MsgType, handler ContextFunc) {
+	router.setRoute(string(msgType), handler)
+}
+
+func (router *Router) Event(event EventType, handler ContextFunc) {
+	router.setRoute(string(MsgEvent)+"."+string(event), handler)
+}
+
+func (router *Router) Key(key string, handler ContextFunc) {
+	router.setRoute(string(MsgClickEvent)+"."+key, handler)
+}
+
+func (router *Router) setRoute(k string, handler ContextFunc) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	router.routes[k] = handler
+}
+
+// EventKey registers handler for the event of the menu button key,
+// e.g. EventKey(EventScanCodePush, "rselfmenu_0_1", handler).
+func (router *Router) EventKey(event EventType, key string, handler ContextFunc) {
+	router.setRoute(string(MsgEvent)+"."+string(event)+"."+key, handler)
+}
+
+// keys returns the keys having a handler, by key event.
+func (router *Router) keys() map[EventType][]string {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+
+	keys := make(map[EventType][]string)
+	for k := range router.routes {
+		for _, event := range keyEvents {
+			prefix := string(MsgEvent) + "." + string(event) + "."
+			if strings.HasPrefix(k, prefix) {
+				keys[event] = append(keys[event], k[len(prefix):])
+			}
+		}
+	}
+	return keys
+}
+
+func (router *Router) HandleFunc(msgType MsgType, handler HandlerFunc) {
+	router.Handle(msgType, Adapt(handler))
+}
+
+func (router *Router) EventFunc(event EventType, handler HandlerFunc) {
+	router.Event(event, Adapt(handler))
+}
+
+func (router *Router) KeyFunc(key string, handler HandlerFunc) {
+	router.Key(key, Adapt(handler))
+}
+
+func (router *Router) EventKeyFunc(event EventType, key string, handler HandlerFunc) {
+	router.EventKey(event, key, Adapt(handler))
+}
+
+func (router *Router) MatchFunc(matcher Matcher, priority int, handler HandlerFunc) {
+	router.Match(matcher, priority, Adapt(handler))
+}
+
+// Match registers handler for the messages matched by matcher.
+// Rules with higher priority are tried first, rules with the same
+// priority in the order of registration.
+func (router *Router) Match(matcher Matcher, priority int, handler ContextFunc) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	i := sort.Search(len(router.rules), func(i int) bool {
+		return router.rules[i].priority < priority
+	})
+	// copy on write, Dispatch ranges over the rules without the lock
+	rules := make([]rule, 0, len(router.rules)+1)
+	rules = append(rules, router.rules[:i]...)
+	rules = append(rules, rule{matcher: matcher, priority: priority, handler: handler})
+	router.rules = append(rules, router.rules[i:]...)
+}
+
+// NotFound sets the handler for the messages no other handler accepts.
+func (router *Router) NotFound(handler ContextFunc) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	router.notFound = handler
+}
+
+func (router *Router) NotFoundFunc(handler HandlerFunc) {
+	router.NotFound(Adapt(handler))
+}
+
+func (router *Router) Dispatch(c *Context) {
+	router.mu.RLock()
+	rules := router.rules
+	router.mu.RUnlock()
+
+	for _, r := range rules {
+		if groups, ok := r.matcher.Match(c.Message); ok {
+			c.Message.Matches = groups
+			r.handler(c)
+			return
+		}
+	}
+
+	router.route(c.Message.Type, c)
+}
+
+// route calls the handler of k, without holding the lock since
+// handlers may route again.
+func (router *Router) route(k string, c *Context) {
+	router.mu.RLock()
+	handle, ok := router.routes[k]
+	notFound := router.notFound
+	router.mu.RUnlock()
+
+	if ok {
+		handle(c)
+		return
+	}
+	if notFound != nil {
+		notFound(c)
+	}
+}
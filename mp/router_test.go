@@ -0,0 +1,126 @@
+// router_test.go
+package mp
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+
+	var got string
+	var groups []string
+	handler := func(name string) HandlerFunc {
+		return func(reply Replyer, m *Message) {
+			got = name
+			groups = m.Matches
+		}
+	}
+
+	router.HandleFunc(MsgText, handler("text"))
+	router.MatchFunc(Prefix("订单"), 0, handler("prefix"))
+	router.MatchFunc(Regexp(`^订单\s*(\d+)$`), 10, handler("regexp"))
+	router.MatchFunc(KeywordFold("help"), 0, handler("help"))
+	router.KeyFunc("V1001", handler("key"))
+	router.NotFoundFunc(handler("notfound"))
+
+	tests := []struct {
+		msg  Message
+		want string
+	}{
+		{Message{MsgHeader: MsgHeader{Type: "text"}, Content: "订单 12345"}, "regexp"},
+		{Message{MsgHeader: MsgHeader{Type: "text"}, Content: "订单 abc"}, "prefix"},
+		{Message{MsgHeader: MsgHeader{Type: "text"}, Content: "HELP"}, "help"},
+		{Message{MsgHeader: MsgHeader{Type: "text"}, Content: "hi"}, "text"},
+		{Message{MsgHeader: MsgHeader{Type: "event"}, Event: "CLICK", EventKey: "V1001"}, "key"},
+		{Message{MsgHeader: MsgHeader{Type: "event"}, Event: "CLICK", EventKey: "V1002"}, "notfound"},
+		{Message{MsgHeader: MsgHeader{Type: "image"}}, "notfound"},
+	}
+	for _, test := range tests {
+		got = ""
+		router.Dispatch(&Context{Message: &test.msg})
+		if got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.msg, got, test.want)
+		}
+	}
+
+	m := Message{MsgHeader: MsgHeader{Type: "text"}, Content: "订单 12345"}
+	router.Dispatch(&Context{Message: &m})
+	if len(groups) != 2 || groups[1] != "12345" {
+		t.Errorf("groups %q", groups)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	router := NewRouter()
+
+	var trace []string
+	mw := func(name string) Middleware {
+		return func(next ContextFunc) ContextFunc {
+			return func(c *Context) {
+				trace = append(trace, name)
+				c.Set(name, true)
+				next(c)
+			}
+		}
+	}
+
+	router.Use(mw("global"))
+	g := router.Group(mw("group"))
+	g.Group(mw("nested")).Handle(MsgText, func(c *Context) {
+		if _, ok := c.Get("global"); !ok {
+			t.Error("value set by middleware not found")
+		}
+		trace = append(trace, "handler")
+		panic("boom")
+	})
+
+	h := chain(router.middlewares, Recover(testLogger{t})(router.Dispatch))
+	h(&Context{Message: &Message{MsgHeader: MsgHeader{Type: "text"}}})
+
+	want := "global,group,nested,handler"
+	if got := strings.Join(trace, ","); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestUseWhileServing(t *testing.T) {
+	mp := New("appid", "secret", "token")
+	mp.SetDedup(nil, DedupReplay)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		body := "<xml><FromUserName>user</FromUserName><MsgType>event</MsgType>" +
+			"<Event>subscribe</Event></xml>"
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mp.ServeHTTP(httptest.NewRecorder(), callbackRequest("token", body))
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		mp.Use(func(next ContextFunc) ContextFunc { return next })
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Println(v ...interface{}) {
+	l.t.Log(v...)
+}
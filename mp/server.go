@@ -0,0 +1,244 @@
+// server
+package mp
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HandlerFunc func(reply Replyer, m *Message)
+
+// Server handles the callback requests pushed by weixin. It only needs
+// the token (and EncodingAESKey in safe mode), not the AppSecret.
+type Server struct {
+	appId     string
+	appToken  string
+	crypter   *MsgCrypter
+	cryptMode CryptMode
+	logger    Logger
+	client    *Client
+	dedup     DedupStore
+	dedupMode DedupMode
+
+	replyTimeout time.Duration
+	replyError   func(m *Message, err error)
+
+	*Router
+}
+
+// NewServer creates a callback server, appId is only needed
+// for message encryption.
+func NewServer(appId, appToken string, opts ...Option) *Server {
+	o := newOptions(opts)
+	srv := &Server{appId: appId, appToken: appToken,
+		logger: o.logger,
+		dedup:  NewMemoryDedupStore(defaultDedupSize, defaultDedupTTL),
+		Router: NewRouter()}
+	if len(o.aesKey) > 0 {
+		if err := srv.SetAESKey(o.aesKey, o.cryptMode); err != nil {
+			panic(err)
+		}
+	}
+	return srv
+}
+
+// SetAESKey enables message encryption with the EncodingAESKey
+// configured in the developer console. In CryptCompatible mode both
+// plaintext and encrypted messages are accepted, in CryptSafe mode
+// only encrypted messages are.
+func (srv *Server) SetAESKey(encodingAESKey string, mode CryptMode) error {
+	if mode == CryptPlain {
+		srv.crypter = nil
+		srv.cryptMode = mode
+		return nil
+	}
+
+	crypter, err := NewMsgCrypter(srv.appId, srv.appToken, encodingAESKey)
+	if err != nil {
+		return err
+	}
+	srv.crypter = crypter
+	srv.cryptMode = mode
+	return nil
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	signature := r.FormValue("signature")
+	timestamp := r.FormValue("timestamp")
+	nonce := r.FormValue("nonce")
+	//log.Println(signature, timestamp, nonce)
+
+	if !CheckSignature(srv.appToken, signature, timestamp, nonce) {
+		srv.logger.Println("checkSignature failed!")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "GET" {
+		fmt.Fprint(w, r.FormValue("echostr"))
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		srv.logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var crypter *MsgCrypter
+	if srv.crypter != nil && r.FormValue("encrypt_type") == "aes" {
+		crypter = srv.crypter
+		data, err = DecryptMessage(crypter, r.FormValue("msg_signature"),
+			timestamp, nonce, data)
+		if err != nil {
+			srv.logger.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else if srv.cryptMode == CryptSafe {
+		srv.logger.Println("plaintext message rejected in safe mode")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	msg, err := DecodeMessage(data)
+	if err != nil {
+		srv.logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := newMessageReply(w, msg, crypter, nonce)
+	if srv.dedup != nil {
+		key := dedupKey(msg)
+		if data, seen := srv.dedup.Claim(key); seen {
+			if srv.dedupMode == DedupReplay && len(data) > 0 {
+				w.Header().Set("Content-Type", xmlContentType)
+				w.Write(data)
+			}
+			return
+		}
+		defer func() {
+			// a handler which panicked did not handle the message,
+			// the retry is dispatched again
+			if err := recover(); err != nil {
+				srv.dedup.Release(key)
+				panic(err)
+			}
+			srv.dedup.Store(key, reply.written())
+		}()
+	}
+
+	reply.client = srv.client
+	reply.onError = func(err error) {
+		srv.onReplyError(msg, err)
+	}
+	c := &Context{Context: r.Context(), Replyer: reply,
+		Request: r, Message: msg, Raw: data,
+		Server: srv, Client: srv.client, reply: reply}
+
+	h := srv.handler()
+	if srv.replyTimeout > 0 {
+		// the handler may outlive the request
+		c.Context = context.WithoutCancel(r.Context())
+		srv.handleTimeout(c, h)
+	} else {
+		h(c)
+	}
+
+	// replies made by handlers still running are sent right away
+	reply.finish()
+
+	if !reply.isReplied() {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// the first reply goes out with the response, the others follow
+	if reply.hasPending() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		go reply.flush()
+	}
+}
+
+// OnReplyError sets the hook called when a reply sent through the
+// customer service API fails, by default the error is logged.
+func (srv *Server) OnReplyError(hook func(m *Message, err error)) {
+	srv.replyError = hook
+}
+
+func (srv *Server) onReplyError(m *Message, err error) {
+	if srv.replyError != nil {
+		srv.replyError(m, err)
+		return
+	}
+	srv.logger.Println("reply to", m.FromUserName, "failed:", err)
+}
+
+// SetReplyTimeout sets how long ServeHTTP waits for the handler, weixin
+// gives up after 5 seconds. Once exceeded, the callback is answered with
+// "success" and the handler's replies are sent through the customer
+// service API by the Client. Zero, the default, waits for the handler.
+func (srv *Server) SetReplyTimeout(timeout time.Duration) {
+	srv.replyTimeout = timeout
+}
+
+// handleTimeout runs h in a goroutine, a panic before the timeout
+// is raised again by handleTimeout.
+func (srv *Server) handleTimeout(c *Context, h ContextFunc) {
+	var p interface{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if p = recover(); p != nil {
+				srv.logger.Println("panic:", p, "\n"+string(debug.Stack()))
+			}
+		}()
+		h(c)
+	}()
+
+	timer := time.NewTimer(srv.replyTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		if p != nil {
+			panic(p)
+		}
+	case <-timer.C:
+		c.reply.timeout()
+	}
+}
+
+// SetClient sets the Client handlers reach through Context.Client.
+func (srv *Server) SetClient(client *Client) {
+	srv.client = client
+}
+
+func (srv *Server) Run(url string, port int) error {
+	http.Handle(url, srv)
+	return http.ListenAndServe(":"+strconv.Itoa(port), nil)
+}
+
+// CheckSignature verifies the signature of a callback request.
+func CheckSignature(token, signature, timestamp, nonce string) bool {
+	list := []string{token, timestamp, nonce}
+	sort.Strings(list)
+
+	h := sha1.New()
+	io.WriteString(h, strings.Join(list, ""))
+
+	return signature == fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,160 @@
+// tag
+package mp
+
+import (
+	"context"
+	"fmt"
+)
+
+// maximal openids of batch tagging
+const maxTagOpenIds = 50
+
+func (c *Client) CreateTag(name string) (Tag, error) {
+	return c.CreateTagContext(context.Background(), name)
+}
+
+func (c *Client) CreateTagContext(ctx context.Context, name string) (Tag, error) {
+	var req, resp struct {
+		Tag Tag `json:"tag"`
+	}
+
+	req.Tag.Name = name
+	if err := c.postJson(ctx, tagCreateUri, "", &req, &resp); err != nil {
+		return Tag{}, err
+	}
+
+	return resp.Tag, nil
+}
+
+func (c *Client) Tags() ([]Tag, error) {
+	return c.TagsContext(context.Background())
+}
+
+func (c *Client) TagsContext(ctx context.Context) ([]Tag, error) {
+	var resp struct {
+		Tags []Tag `json:"tags"`
+	}
+
+	if err := c.getJson(ctx, tagQueryUri, "", &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Tags, nil
+}
+
+// UpdateTag renames the tag tag.Id to tag.Name.
+func (c *Client) UpdateTag(tag Tag) error {
+	return c.UpdateTagContext(context.Background(), tag)
+}
+
+func (c *Client) UpdateTagContext(ctx context.Context, tag Tag) error {
+	var req struct {
+		Tag Tag `json:"tag"`
+	}
+
+	req.Tag = Tag{Id: tag.Id, Name: tag.Name}
+	return c.sendJson(ctx, tagUpdateUri, &req)
+}
+
+func (c *Client) DeleteTag(tagId int) error {
+	return c.DeleteTagContext(context.Background(), tagId)
+}
+
+func (c *Client) DeleteTagContext(ctx context.Context, tagId int) error {
+	var req struct {
+		Tag struct {
+			Id int `json:"id"`
+		} `json:"tag"`
+	}
+
+	req.Tag.Id = tagId
+	return c.sendJson(ctx, tagDelUri, &req)
+}
+
+// TagMembers returns up to 10000 openids of the users tagged with tagId,
+// starting after start. next is empty after the last page.
+func (c *Client) TagMembers(tagId int, start string) ([]string, string, error) {
+	return c.TagMembersContext(context.Background(), tagId, start)
+}
+
+func (c *Client) TagMembersContext(ctx context.Context, tagId int, start string) (openIds []string, next string, err error) {
+	var req struct {
+		TagId int    `json:"tagid"`
+		Next  string `json:"next_openid"`
+	}
+
+	var resp struct {
+		Count int `json:"count"`
+		Data  struct {
+			OpenId []string `json:"openid"`
+		} `json:"data"`
+		Next string `json:"next_openid"`
+	}
+
+	req.TagId = tagId
+	req.Next = start
+	if err = c.postJson(ctx, tagUsersUri, "", &req, &resp); err != nil {
+		return
+	}
+
+	if resp.Count == 0 {
+		return nil, "", nil
+	}
+	return resp.Data.OpenId, resp.Next, nil
+}
+
+// TagUsers tags the users openIds with tagId, at most 50 at once.
+func (c *Client) TagUsers(tagId int, openIds []string) error {
+	return c.TagUsersContext(context.Background(), tagId, openIds)
+}
+
+func (c *Client) TagUsersContext(ctx context.Context, tagId int, openIds []string) error {
+	return c.batchTagging(ctx, tagBatchTaggingUri, tagId, openIds)
+}
+
+// UntagUsers removes tagId from the users openIds, at most 50 at once.
+func (c *Client) UntagUsers(tagId int, openIds []string) error {
+	return c.UntagUsersContext(context.Background(), tagId, openIds)
+}
+
+func (c *Client) UntagUsersContext(ctx context.Context, tagId int, openIds []string) error {
+	return c.batchTagging(ctx, tagBatchUntaggingUri, tagId, openIds)
+}
+
+func (c *Client) batchTagging(ctx context.Context, uri string, tagId int, openIds []string) error {
+	if len(openIds) == 0 || len(openIds) > maxTagOpenIds {
+		return &APIError{Code: OpenIdListLenInvalid, Endpoint: uri,
+			Msg: fmt.Sprintf("%d openids, want 1 to %d", len(openIds), maxTagOpenIds)}
+	}
+
+	var req struct {
+		OpenIds []string `json:"openid_list"`
+		TagId   int      `json:"tagid"`
+	}
+
+	req.OpenIds = openIds
+	req.TagId = tagId
+	return c.sendJson(ctx, uri, &req)
+}
+
+// UserTagIds returns the ids of the tags of the user openId.
+func (c *Client) UserTagIds(openId string) ([]int, error) {
+	return c.UserTagIdsContext(context.Background(), openId)
+}
+
+func (c *Client) UserTagIdsContext(ctx context.Context, openId string) ([]int, error) {
+	var req struct {
+		OpenId string `json:"openid"`
+	}
+
+	var resp struct {
+		TagIds []int `json:"tagid_list"`
+	}
+
+	req.OpenId = openId
+	if err := c.postJson(ctx, tagIdListUri, "", &req, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.TagIds, nil
+}
@@ -0,0 +1,88 @@
+// tag_test.go
+package mp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	var tagged struct {
+		OpenIds []string `json:"openid_list"`
+		TagId   int      `json:"tagid"`
+	}
+	var moved map[string]interface{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(tagCreateUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tag":{"id":134,"name":"广东"}}`)
+	})
+	mux.HandleFunc(tagUsersUri, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Next string `json:"next_openid"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Next == "" {
+			fmt.Fprint(w, `{"count":2,"data":{"openid":["o1","o2"]},"next_openid":"o2"}`)
+			return
+		}
+		fmt.Fprint(w, `{"count":0,"next_openid":""}`)
+	})
+	mux.HandleFunc(tagBatchTaggingUri, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&tagged)
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	mux.HandleFunc(tagIdListUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tagid_list":[134,2]}`)
+	})
+	mux.HandleFunc(groupMemberUpdateUri, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&moved)
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	c := newTestClient(t, mux)
+
+	tag, err := c.CreateTag("广东")
+	if err != nil || tag.Id != 134 {
+		t.Fatalf("create: %+v, %v", tag, err)
+	}
+
+	var members []string
+	for next := ""; ; {
+		openIds, n, err := c.TagMembers(134, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, openIds...)
+		if next = n; next == "" {
+			break
+		}
+	}
+	if len(members) != 2 {
+		t.Errorf("members %q", members)
+	}
+
+	if err := c.TagUsers(134, []string{"o1", "o2"}); err != nil {
+		t.Fatal(err)
+	}
+	if tagged.TagId != 134 || len(tagged.OpenIds) != 2 {
+		t.Errorf("tagging request %+v", tagged)
+	}
+	if err := c.TagUsers(134, make([]string, 51)); !errors.Is(err, ErrOpenIdListLenInvalid) {
+		t.Errorf("51 openids: %v", err)
+	}
+
+	ids, err := c.UserTagIds("o1")
+	if err != nil || len(ids) != 2 || ids[0] != 134 {
+		t.Errorf("tag ids %v, %v", ids, err)
+	}
+
+	if err := c.MoveMember2Group("o1", 108); err != nil {
+		t.Fatal(err)
+	}
+	if moved["openid"] != "o1" || moved["to_groupid"] != float64(108) {
+		t.Errorf("move request %v", moved)
+	}
+}
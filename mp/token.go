@@ -0,0 +1,284 @@
+// token
+package mp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	tokenLeeway        = 60 * time.Second
+	tokenRetryInterval = 3 * time.Second
+	defaultTokenAhead  = 5 * time.Minute
+	tokenTimeout       = 30 * time.Second
+)
+
+type Token struct {
+	AccessToken string    `json:"access_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Valid reports whether the token is still usable for at least d.
+func (t Token) Valid(d time.Duration) bool {
+	return len(t.AccessToken) > 0 && time.Now().Add(d).Before(t.ExpiresAt)
+}
+
+// TokenStore keeps the access token, so that it survives restarts
+// and can be shared between processes.
+type TokenStore interface {
+	Token() (Token, error)
+	SetToken(token Token) error
+}
+
+type MemoryTokenStore struct {
+	mu    sync.RWMutex
+	token Token
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{}
+}
+
+func (s *MemoryTokenStore) Token() (Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.token, nil
+}
+
+func (s *MemoryTokenStore) SetToken(token Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+	return nil
+}
+
+// FileTokenStore keeps the token in a JSON file. The file is replaced
+// atomically, so several processes can read it, but each process renews
+// the token on its own. Processes sharing the file should run the
+// refresher, which renews at a random time ahead of the expiration and
+// first checks whether another process did it already.
+type FileTokenStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{path: path}
+}
+
+func (s *FileTokenStore) Token() (token Token, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return token, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &token)
+	return
+}
+
+func (s *FileTokenStore) SetToken(token Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(&token)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces the file path with data by renaming a temporary
+// file, so that readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+type tokenCall struct {
+	done  chan struct{}
+	token Token
+	err   error
+}
+
+func (c *Client) SetTokenStore(store TokenStore) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.tokenStore = store
+}
+
+func (c *Client) store() TokenStore {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.tokenStore
+}
+
+// accessToken returns a valid access token, requesting a new one if the
+// stored token is missing or about to expire.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	token, err := c.store().Token()
+	if err != nil {
+		c.logger.Println(err)
+	}
+	if token.Valid(tokenLeeway) {
+		return token.AccessToken, nil
+	}
+
+	if token, err = c.refreshToken(ctx, token.AccessToken); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// refreshToken replaces the stale token. Concurrent callers share a single
+// request, and a token already renewed by someone else is used as is.
+// The request is not bound to ctx, so a caller giving up does not fail
+// the others, each caller stops waiting when its own ctx is done.
+func (c *Client) refreshToken(ctx context.Context, stale string) (Token, error) {
+	c.tokenMu.Lock()
+	call := c.tokenCall
+	if call == nil {
+		call = &tokenCall{done: make(chan struct{})}
+		c.tokenCall = call
+		go c.doRefresh(context.WithoutCancel(ctx), call, c.tokenStore, stale)
+	}
+	c.tokenMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
+	}
+}
+
+func (c *Client) doRefresh(ctx context.Context, call *tokenCall, store TokenStore, stale string) {
+	defer func() {
+		c.tokenMu.Lock()
+		c.tokenCall = nil
+		c.tokenMu.Unlock()
+		close(call.done)
+	}()
+
+	if token, err := store.Token(); err == nil &&
+		token.AccessToken != stale && token.Valid(tokenLeeway) {
+		call.token = token
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenTimeout)
+	defer cancel()
+	if call.token, call.err = c.requestToken(ctx); call.err != nil {
+		return
+	}
+	if err := store.SetToken(call.token); err != nil {
+		c.logger.Println(err)
+	}
+}
+
+// retry <= 0: infinite retry
+func (c *Client) RefreshToken(retry int) (err error) {
+	for {
+		token, _ := c.store().Token()
+		if _, err = c.refreshToken(context.Background(), token.AccessToken); err == nil {
+			return nil
+		}
+		c.logger.Println(err)
+
+		retry--
+		if retry == 0 {
+			return
+		}
+		time.Sleep(tokenRetryInterval)
+	}
+}
+
+// StartTokenRefresh renews the access token in background, ahead of its
+// expiration. ahead is capped at half the token lifetime (7200s), plus a
+// random part of up to a quarter of it, so that several processes
+// sharing a TokenStore do not renew at once.
+func (c *Client) StartTokenRefresh(ahead time.Duration) {
+	if ahead <= 0 {
+		ahead = defaultTokenAhead
+	}
+
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.refreshStop != nil {
+		return
+	}
+	c.refreshStop = make(chan struct{})
+	go c.refreshLoop(ahead, c.refreshStop)
+}
+
+func (c *Client) StopTokenRefresh() {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.refreshStop != nil {
+		close(c.refreshStop)
+		c.refreshStop = nil
+	}
+}
+
+func (c *Client) refreshLoop(ahead time.Duration, stop chan struct{}) {
+	var lifetime time.Duration
+	attempted, failed := false, false
+	for {
+		token, err := c.store().Token()
+		if err != nil {
+			c.logger.Println(err)
+		}
+
+		d := ahead
+		if lifetime > 0 && d > lifetime/2 {
+			d = lifetime / 2
+		}
+		d += time.Duration(rand.Int63n(int64(d)/4 + 1))
+
+		// back off after a failure, or if the new token is already due
+		wait := token.ExpiresAt.Add(-d).Sub(time.Now())
+		if (failed || attempted && wait <= 0) && wait < tokenRetryInterval {
+			wait = tokenRetryInterval
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		// refreshToken does not renew if the store has a newer token
+		token, err = c.refreshToken(context.Background(), token.AccessToken)
+		if err != nil {
+			c.logger.Println(err)
+		} else if d := time.Until(token.ExpiresAt); d > lifetime {
+			lifetime = d
+		}
+		attempted, failed = true, err != nil
+	}
+}
@@ -0,0 +1,145 @@
+// token_test.go
+package mp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileTokenStore(filepath.Join(dir, "token.json"))
+	token, err := store.Token()
+	if err != nil || token.Valid(0) {
+		t.Fatalf("empty store: %v, %v", token, err)
+	}
+
+	want := Token{AccessToken: "abc", ExpiresAt: time.Now().Add(time.Hour).Round(0)}
+	if err := store.SetToken(want); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second store on the same file sees the token
+	mp := New("appid", "secret", "token")
+	mp.SetTokenStore(NewFileTokenStore(filepath.Join(dir, "token.json")))
+	got, err := mp.accessToken(context.Background())
+	if err != nil || got != want.AccessToken {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestTokenRefreshCallerGivesUp(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenUri, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, `{"access_token":"token","expires_in":7200}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c := NewClient("appid", "secret", WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.accessToken(ctx)
+		errc <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	token, err := c.accessToken(context.Background())
+	if err != nil || token != "token" {
+		t.Fatalf("got %q, %v", token, err)
+	}
+	if err := <-errc; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("leader: got %v, want deadline exceeded", err)
+	}
+}
+
+func TestTokenSingleFlight(t *testing.T) {
+	srv, state := fakeServer(t)
+	defer srv.Close()
+	c := NewClient("appid", "secret", WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := c.accessToken(context.Background()); err != nil || token != "token1" {
+				t.Errorf("got %q, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&state.tokens); n != 1 {
+		t.Fatalf("%d token requests, want 1", n)
+	}
+}
+
+func TestTokenRefresher(t *testing.T) {
+	var tokens int32
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenUri, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokens, 1)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":1}`, n)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c := NewClient("appid", "secret", WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+
+	expiresAt := time.Now().Add(time.Second)
+	c.store().SetToken(Token{AccessToken: "old", ExpiresAt: expiresAt})
+
+	c.StartTokenRefresh(800 * time.Millisecond)
+	for atomic.LoadInt32(&tokens) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if now := time.Now(); !now.Before(expiresAt) {
+		t.Errorf("refreshed %v after the expiration", now.Sub(expiresAt))
+	}
+
+	c.StopTokenRefresh()
+	n := atomic.LoadInt32(&tokens)
+	time.Sleep(1100 * time.Millisecond)
+	// a refresh may have been running when stopped
+	if got := atomic.LoadInt32(&tokens); got > n+1 {
+		t.Fatalf("%d token requests after stop", got-n)
+	}
+}
+
+func TestTokenRefreshAheadCapped(t *testing.T) {
+	var tokens int32
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenUri, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokens, 1)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":2}`, n)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c := NewClient("appid", "secret", WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+
+	// ahead exceeds the lifetime, the tokens are renewed at about half of it
+	c.StartTokenRefresh(3 * time.Hour)
+	defer c.StopTokenRefresh()
+	time.Sleep(2500 * time.Millisecond)
+	if n := atomic.LoadInt32(&tokens); n < 2 || n > 4 {
+		t.Fatalf("%d token requests in 2.5s, want 2 to 4", n)
+	}
+}
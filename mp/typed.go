@@ -0,0 +1,362 @@
+// typed messages
+package mp
+
+// EventHeader is the header of the event messages.
+type EventHeader struct {
+	MsgHeader
+	Event string
+}
+
+type TextMessage struct {
+	MsgHeader
+	MsgId   uint64
+	Content string
+}
+
+type ImageMessage struct {
+	MsgHeader
+	MsgId   uint64
+	PicUrl  string
+	MediaId string
+}
+
+type VoiceMessage struct {
+	MsgHeader
+	MsgId       uint64
+	MediaId     string
+	Format      string
+	Recognition string // set if speech recognition is enabled
+}
+
+type VideoMessage struct {
+	MsgHeader
+	MsgId        uint64
+	MediaId      string
+	ThumbMediaId string
+}
+
+type ShortVideoMessage struct {
+	MsgHeader
+	MsgId        uint64
+	MediaId      string
+	ThumbMediaId string
+}
+
+type FileMessage struct {
+	MsgHeader
+	MsgId        uint64
+	Title        string
+	Description  string
+	FileKey      string
+	FileMd5      string
+	FileTotalLen int64
+}
+
+type LocationMessage struct {
+	MsgHeader
+	MsgId     uint64
+	LocationX float64
+	LocationY float64
+	Scale     int
+	Label     string
+}
+
+type LinkMessage struct {
+	MsgHeader
+	MsgId       uint64
+	Title       string
+	Description string
+	Url         string
+}
+
+// SubscribeEvent is sent on subscription, EventKey is qrscene_ followed
+// by the scene and Ticket is set if the user scanned a QR code.
+type SubscribeEvent struct {
+	EventHeader
+	EventKey string
+	Ticket   string
+}
+
+type UnsubscribeEvent struct {
+	EventHeader
+}
+
+// ScanEvent is sent when a subscribed user scans a QR code, EventKey
+// is the scene.
+type ScanEvent struct {
+	EventHeader
+	EventKey string
+	Ticket   string
+}
+
+// LocationEvent reports the location of the user, if enabled.
+type LocationEvent struct {
+	EventHeader
+	Latitude  float64
+	Longitude float64
+	Precision float64
+}
+
+type ClickEvent struct {
+	EventHeader
+	EventKey string
+}
+
+type ViewEvent struct {
+	EventHeader
+	EventKey string // the url
+	MenuId   string
+}
+
+type ViewMiniprogramEvent struct {
+	EventHeader
+	EventKey string // the pagepath
+	MenuId   string
+}
+
+// ScanCodeEvent is sent for the scancode_push and scancode_waitmsg
+// buttons, EventKey is the key of the button.
+type ScanCodeEvent struct {
+	EventHeader
+	EventKey     string
+	ScanCodeInfo ScanCodeInfo
+}
+
+// PicsEvent is sent for the pic_sysphoto, pic_photo_or_album and
+// pic_weixin buttons, EventKey is the key of the button.
+type PicsEvent struct {
+	EventHeader
+	EventKey     string
+	SendPicsInfo SendPicsInfo
+}
+
+// LocationSelectEvent is sent for the location_select buttons, EventKey
+// is the key of the button.
+type LocationSelectEvent struct {
+	EventHeader
+	EventKey         string
+	SendLocationInfo SendLocationInfo
+}
+
+// MassSendJobFinishEvent reports the result of a mass send job, MsgID
+// is the id of the job.
+type MassSendJobFinishEvent struct {
+	EventHeader
+	MsgID                uint64
+	Status               string
+	TotalCount           int
+	FilterCount          int
+	SentCount            int
+	ErrorCount           int
+	CopyrightCheckResult CopyrightCheckResult
+}
+
+// TemplateSendJobFinishEvent reports whether a template message was
+// delivered, MsgID is the id returned when it was sent.
+type TemplateSendJobFinishEvent struct {
+	EventHeader
+	MsgID  uint64
+	Status string
+}
+
+// DecodeTypedMessage parses the plaintext XML of a callback message
+// into one of the typed messages, see TypedMessage.
+func DecodeTypedMessage(data []byte) (interface{}, error) {
+	m, err := DecodeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return TypedMessage(m), nil
+}
+
+// TypedMessage returns the typed message of m, e.g. a *TextMessage or a
+// *SubscribeEvent, or m itself if there is no typed message for it.
+func TypedMessage(m *Message) interface{} {
+	h := m.MsgHeader
+	eh := EventHeader{MsgHeader: h, Event: m.Event}
+
+	switch MsgType(m.Type) {
+	case MsgText:
+		return &TextMessage{h, m.MsgId, m.Content}
+	case MsgImage:
+		return &ImageMessage{h, m.MsgId, m.PicUrl, m.MediaId}
+	case MsgVoice:
+		return &VoiceMessage{h, m.MsgId, m.MediaId, m.Format, m.Recognition}
+	case MsgVideo:
+		return &VideoMessage{h, m.MsgId, m.MediaId, m.ThumbMediaId}
+	case MsgShortVideo:
+		return &ShortVideoMessage{h, m.MsgId, m.MediaId, m.ThumbMediaId}
+	case MsgFile:
+		return &FileMessage{h, m.MsgId, m.Title, m.Description,
+			m.FileKey, m.FileMd5, m.FileTotalLen}
+	case MsgLocation:
+		return &LocationMessage{h, m.MsgId, m.LocationX, m.LocationY, m.Scale, m.Label}
+	case MsgLink:
+		return &LinkMessage{h, m.MsgId, m.Title, m.Description, m.Url}
+	case MsgEvent:
+		switch EventType(m.Event) {
+		case EventSubscribe:
+			return &SubscribeEvent{eh, m.EventKey, m.Ticket}
+		case EventUnsubscribe:
+			return &UnsubscribeEvent{eh}
+		case EventScan:
+			return &ScanEvent{eh, m.EventKey, m.Ticket}
+		case EventLocation:
+			return &LocationEvent{eh, m.Latitude, m.Longitude, m.Precision}
+		case EventClick:
+			return &ClickEvent{eh, m.EventKey}
+		case EventView:
+			return &ViewEvent{eh, m.EventKey, m.MenuId}
+		case EventViewMiniprogram:
+			return &ViewMiniprogramEvent{eh, m.EventKey, m.MenuId}
+		case EventScanCodePush, EventScanCodeWaitMsg:
+			return &ScanCodeEvent{eh, m.EventKey, m.ScanCodeInfo}
+		case EventPicSysPhoto, EventPicPhotoOrAlbum, EventPicWeixin:
+			return &PicsEvent{eh, m.EventKey, m.SendPicsInfo}
+		case EventLocationSelect:
+			return &LocationSelectEvent{eh, m.EventKey, m.SendLocationInfo}
+		case EventMassSendJobFinish:
+			return &MassSendJobFinishEvent{eh, m.MsgID, m.Status, m.TotalCount,
+				m.FilterCount, m.SentCount, m.ErrorCount, m.CopyrightCheckResult}
+		case EventTemplateSendJobFinish:
+			return &TemplateSendJobFinishEvent{eh, m.MsgID, m.Status}
+		}
+	}
+	return m
+}
+
+// Typed returns the typed message of c.Message, see TypedMessage.
+func (c *Context) Typed() interface{} {
+	return TypedMessage(c.Message)
+}
+
+func (router *Router) OnText(handler func(c *Context, m *TextMessage)) {
+	router.Handle(MsgText, func(c *Context) {
+		handler(c, c.Typed().(*TextMessage))
+	})
+}
+
+func (router *Router) OnImage(handler func(c *Context, m *ImageMessage)) {
+	router.Handle(MsgImage, func(c *Context) {
+		handler(c, c.Typed().(*ImageMessage))
+	})
+}
+
+func (router *Router) OnVoice(handler func(c *Context, m *VoiceMessage)) {
+	router.Handle(MsgVoice, func(c *Context) {
+		handler(c, c.Typed().(*VoiceMessage))
+	})
+}
+
+func (router *Router) OnVideo(handler func(c *Context, m *VideoMessage)) {
+	router.Handle(MsgVideo, func(c *Context) {
+		handler(c, c.Typed().(*VideoMessage))
+	})
+}
+
+func (router *Router) OnShortVideo(handler func(c *Context, m *ShortVideoMessage)) {
+	router.Handle(MsgShortVideo, func(c *Context) {
+		handler(c, c.Typed().(*ShortVideoMessage))
+	})
+}
+
+func (router *Router) OnFile(handler func(c *Context, m *FileMessage)) {
+	router.Handle(MsgFile, func(c *Context) {
+		handler(c, c.Typed().(*FileMessage))
+	})
+}
+
+func (router *Router) OnLocation(handler func(c *Context, m *LocationMessage)) {
+	router.Handle(MsgLocation, func(c *Context) {
+		handler(c, c.Typed().(*LocationMessage))
+	})
+}
+
+func (router *Router) OnLink(handler func(c *Context, m *LinkMessage)) {
+	router.Handle(MsgLink, func(c *Context) {
+		handler(c, c.Typed().(*LinkMessage))
+	})
+}
+
+func (router *Router) OnSubscribe(handler func(c *Context, e *SubscribeEvent)) {
+	router.Event(EventSubscribe, func(c *Context) {
+		handler(c, c.Typed().(*SubscribeEvent))
+	})
+}
+
+func (router *Router) OnUnsubscribe(handler func(c *Context, e *UnsubscribeEvent)) {
+	router.Event(EventUnsubscribe, func(c *Context) {
+		handler(c, c.Typed().(*UnsubscribeEvent))
+	})
+}
+
+func (router *Router) OnScan(handler func(c *Context, e *ScanEvent)) {
+	router.Event(EventScan, func(c *Context) {
+		handler(c, c.Typed().(*ScanEvent))
+	})
+}
+
+func (router *Router) OnLocationEvent(handler func(c *Context, e *LocationEvent)) {
+	router.Event(EventLocation, func(c *Context) {
+		handler(c, c.Typed().(*LocationEvent))
+	})
+}
+
+// OnClick registers handler for the click event of the menu button key.
+func (router *Router) OnClick(key string, handler func(c *Context, e *ClickEvent)) {
+	router.Key(key, func(c *Context) {
+		handler(c, c.Typed().(*ClickEvent))
+	})
+}
+
+func (router *Router) OnView(handler func(c *Context, e *ViewEvent)) {
+	router.Event(EventView, func(c *Context) {
+		handler(c, c.Typed().(*ViewEvent))
+	})
+}
+
+func (router *Router) OnViewMiniprogram(handler func(c *Context, e *ViewMiniprogramEvent)) {
+	router.Event(EventViewMiniprogram, func(c *Context) {
+		handler(c, c.Typed().(*ViewMiniprogramEvent))
+	})
+}
+
+// OnScanCode registers handler for the scancode_push and scancode_waitmsg
+// events of the menu button key.
+func (router *Router) OnScanCode(key string, handler func(c *Context, e *ScanCodeEvent)) {
+	h := func(c *Context) {
+		handler(c, c.Typed().(*ScanCodeEvent))
+	}
+	router.EventKey(EventScanCodePush, key, h)
+	router.EventKey(EventScanCodeWaitMsg, key, h)
+}
+
+// OnPics registers handler for the pic_* events of the menu button key.
+func (router *Router) OnPics(key string, handler func(c *Context, e *PicsEvent)) {
+	h := func(c *Context) {
+		handler(c, c.Typed().(*PicsEvent))
+	}
+	router.EventKey(EventPicSysPhoto, key, h)
+	router.EventKey(EventPicPhotoOrAlbum, key, h)
+	router.EventKey(EventPicWeixin, key, h)
+}
+
+// OnLocationSelect registers handler for the location_select event of
+// the menu button key.
+func (router *Router) OnLocationSelect(key string, handler func(c *Context, e *LocationSelectEvent)) {
+	router.EventKey(EventLocationSelect, key, func(c *Context) {
+		handler(c, c.Typed().(*LocationSelectEvent))
+	})
+}
+
+func (router *Router) OnMassSendJobFinish(handler func(c *Context, e *MassSendJobFinishEvent)) {
+	router.Event(EventMassSendJobFinish, func(c *Context) {
+		handler(c, c.Typed().(*MassSendJobFinishEvent))
+	})
+}
+
+func (router *Router) OnTemplateSendJobFinish(handler func(c *Context, e *TemplateSendJobFinishEvent)) {
+	router.Event(EventTemplateSendJobFinish, func(c *Context) {
+		handler(c, c.Typed().(*TemplateSendJobFinishEvent))
+	})
+}
@@ -0,0 +1,170 @@
+// typed_test.go
+package mp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestTypedMessage(t *testing.T) {
+	router := NewRouter()
+
+	var got interface{}
+	router.OnText(func(c *Context, m *TextMessage) { got = m })
+	router.OnSubscribe(func(c *Context, e *SubscribeEvent) { got = e })
+	router.OnClick("V1001", func(c *Context, e *ClickEvent) { got = e })
+
+	dispatch := func(xml string) {
+		m, err := DecodeMessage([]byte(xml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		router.Dispatch(&Context{Message: m})
+	}
+
+	dispatch(`<xml><FromUserName>oUser</FromUserName><MsgType>text</MsgType>
+		<Content>hello</Content><MsgId>1234567890123456</MsgId></xml>`)
+	if m, ok := got.(*TextMessage); !ok || m.Content != "hello" ||
+		m.MsgId != 1234567890123456 || m.FromUserName != "oUser" {
+		t.Errorf("text: got %#v", got)
+	}
+
+	dispatch(`<xml><MsgType>event</MsgType><Event>subscribe</Event>
+		<EventKey>qrscene_123</EventKey><Ticket>TICKET</Ticket></xml>`)
+	if e, ok := got.(*SubscribeEvent); !ok || e.EventKey != "qrscene_123" || e.Ticket != "TICKET" {
+		t.Errorf("subscribe: got %#v", got)
+	}
+
+	dispatch(`<xml><MsgType>event</MsgType><Event>CLICK</Event><EventKey>V1001</EventKey></xml>`)
+	if e, ok := got.(*ClickEvent); !ok || e.Event != "CLICK" {
+		t.Errorf("click: got %#v", got)
+	}
+
+	v, err := DecodeTypedMessage([]byte(`<xml><MsgType>location</MsgType>
+		<Location_X>23.134521</Location_X><Location_Y>113.358803</Location_Y>
+		<Scale>20</Scale><Label>位置信息</Label></xml>`))
+	if m, ok := v.(*LocationMessage); err != nil || !ok || m.Scale != 20 || m.LocationX != 23.134521 {
+		t.Errorf("location: got %#v, %v", v, err)
+	}
+
+	v, _ = DecodeTypedMessage([]byte(`<xml><MsgType>event</MsgType><Event>user_get_card</Event></xml>`))
+	if _, ok := v.(*Message); !ok {
+		t.Errorf("unknown event: got %#v", v)
+	}
+}
+
+func TestShortVideoAndFile(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(mediaDownloadUri, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.FormValue("media_id"))
+	})
+	client := newTestClient(t, mux)
+
+	router := NewRouter()
+	var got interface{}
+	var media string
+	router.OnShortVideo(func(c *Context, m *ShortVideoMessage) {
+		got = m
+		r, err := c.DownloadMedia(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		media = string(data)
+	})
+	router.HandleFunc(MsgFile, func(reply Replyer, m *Message) { got = m })
+
+	m, _ := DecodeMessage([]byte(`<xml><MsgType>shortvideo</MsgType><MediaId>media_id</MediaId>
+		<ThumbMediaId>thumb_media_id</ThumbMediaId><MsgId>1234567890123456</MsgId></xml>`))
+	router.Dispatch(&Context{Context: context.Background(), Message: m, Client: client})
+	if v, ok := got.(*ShortVideoMessage); !ok || v.MediaId != "media_id" {
+		t.Fatalf("shortvideo: got %#v", got)
+	}
+	if media != "thumb_media_id" {
+		t.Errorf("downloaded %q", media)
+	}
+
+	m, _ = DecodeMessage([]byte(`<xml><MsgType>file</MsgType><Title>a.pdf</Title>
+		<Description>report</Description><FileKey>key</FileKey><FileMd5>d41d8cd9</FileMd5>
+		<FileTotalLen>1024</FileTotalLen></xml>`))
+	router.Dispatch(&Context{Message: m})
+	if got != m || m.FileTotalLen != 1024 || m.Title != "a.pdf" {
+		t.Fatalf("file: got %#v", got)
+	}
+	if f, ok := TypedMessage(m).(*FileMessage); !ok || f.FileMd5 != "d41d8cd9" {
+		t.Errorf("typed file %#v", f)
+	}
+}
+
+func TestTypedMenuEvents(t *testing.T) {
+	router := NewRouter()
+
+	var got interface{}
+	router.OnScanCode("rselfmenu_0_1", func(c *Context, e *ScanCodeEvent) { got = e })
+	router.OnPics("rselfmenu_1_0", func(c *Context, e *PicsEvent) { got = e })
+	router.OnLocationSelect("rselfmenu_2_0", func(c *Context, e *LocationSelectEvent) { got = e })
+	router.OnViewMiniprogram(func(c *Context, e *ViewMiniprogramEvent) { got = e })
+	router.OnMassSendJobFinish(func(c *Context, e *MassSendJobFinishEvent) { got = e })
+	router.OnTemplateSendJobFinish(func(c *Context, e *TemplateSendJobFinishEvent) { got = e })
+
+	dispatch := func(xml string) {
+		m, err := DecodeMessage([]byte(xml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		router.Dispatch(&Context{Message: m})
+	}
+
+	dispatch(`<xml><MsgType>event</MsgType><Event>scancode_waitmsg</Event>
+		<EventKey>rselfmenu_0_1</EventKey><ScanCodeInfo><ScanType>qrcode</ScanType>
+		<ScanResult>1</ScanResult></ScanCodeInfo></xml>`)
+	if e, ok := got.(*ScanCodeEvent); !ok || e.ScanCodeInfo.ScanType != "qrcode" ||
+		e.ScanCodeInfo.ScanResult != "1" {
+		t.Errorf("scancode: got %#v", got)
+	}
+
+	dispatch(`<xml><MsgType>event</MsgType><Event>pic_weixin</Event>
+		<EventKey>rselfmenu_1_0</EventKey><SendPicsInfo><Count>1</Count>
+		<PicList><item><PicMd5Sum>5a75aaca956d97be686719218f275c6b</PicMd5Sum></item></PicList>
+		</SendPicsInfo></xml>`)
+	if e, ok := got.(*PicsEvent); !ok || e.SendPicsInfo.Count != 1 ||
+		len(e.SendPicsInfo.PicList) != 1 {
+		t.Errorf("pics: got %#v", got)
+	}
+
+	dispatch(`<xml><MsgType>event</MsgType><Event>location_select</Event>
+		<EventKey>rselfmenu_2_0</EventKey><SendLocationInfo><Location_X>23</Location_X>
+		<Location_Y>113</Location_Y><Scale>15</Scale><Label>广州市海珠区</Label>
+		<Poiname></Poiname></SendLocationInfo></xml>`)
+	if e, ok := got.(*LocationSelectEvent); !ok || e.SendLocationInfo.LocationX != 23 ||
+		e.SendLocationInfo.Label != "广州市海珠区" {
+		t.Errorf("location_select: got %#v", got)
+	}
+
+	dispatch(`<xml><MsgType>event</MsgType><Event>view_miniprogram</Event>
+		<EventKey>pages/index/index</EventKey><MenuId>MENUID</MenuId></xml>`)
+	if e, ok := got.(*ViewMiniprogramEvent); !ok || e.EventKey != "pages/index/index" ||
+		e.MenuId != "MENUID" {
+		t.Errorf("view_miniprogram: got %#v", got)
+	}
+
+	dispatch(`<xml><MsgType>event</MsgType><Event>MASSSENDJOBFINISH</Event>
+		<MsgID>1988</MsgID><Status>sendsuccess</Status><TotalCount>100</TotalCount>
+		<FilterCount>80</FilterCount><SentCount>75</SentCount><ErrorCount>5</ErrorCount></xml>`)
+	if e, ok := got.(*MassSendJobFinishEvent); !ok || e.MsgID != 1988 ||
+		e.TotalCount != 100 || e.FilterCount != 80 || e.SentCount != 75 || e.ErrorCount != 5 {
+		t.Errorf("mass send: got %#v", got)
+	}
+
+	dispatch(`<xml><MsgType>event</MsgType><Event>TEMPLATESENDJOBFINISH</Event>
+		<MsgID>200163836</MsgID><Status>success</Status></xml>`)
+	if e, ok := got.(*TemplateSendJobFinishEvent); !ok || e.MsgID != 200163836 ||
+		e.Status != "success" {
+		t.Errorf("template send: got %#v", got)
+	}
+}
@@ -11,17 +11,28 @@ type Group struct {
 	Count int    `json:"count,omitempty"`
 }
 
+type Tag struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count,omitempty"`
+}
+
 type User struct {
-	Subscribe     int    `json:"subscribe"`
-	OpenId        string `json:"openid"`
-	Nickname      string `json:"nickname"`
-	Sex           int    `json:"sex"`
-	Language      string `json:"language"`
-	City          string `json:"city"`
-	Province      string `json:"province"`
-	Country       string `json:"country"`
-	HeadImgUrl    string `json:"headimgurl"`
-	SubscribeTime int64  `json:"subscribe_time"`
+	Subscribe      int    `json:"subscribe"`
+	OpenId         string `json:"openid"`
+	Nickname       string `json:"nickname"`
+	Sex            int    `json:"sex"`
+	Language       string `json:"language"`
+	City           string `json:"city"`
+	Province       string `json:"province"`
+	Country        string `json:"country"`
+	HeadImgUrl     string `json:"headimgurl"`
+	SubscribeTime  int64  `json:"subscribe_time"`
+	Remark         string `json:"remark"`
+	TagIdList      []int  `json:"tagid_list,omitempty"`
+	SubscribeScene string `json:"subscribe_scene"` // e.g. ADD_SCENE_QR_CODE
+	QrScene        int    `json:"qr_scene"`
+	QrSceneStr     string `json:"qr_scene_str"`
 }
 
 type OpenIdList struct {